@@ -98,8 +98,8 @@ class APIClient: ObservableObject {
         return try decoder.decode(Stats.self, from: data)
     }
 
-    func thumbnailURL(for photo: Photo) -> URL {
-        URL(string: "\(baseURL)/api/photos/\(photo.id)/thumbnail")!
+    func thumbnailURL(for photo: Photo, size: String = "thumb") -> URL {
+        URL(string: "\(baseURL)/api/photos/\(photo.id)/thumbnail?size=\(size)")!
     }
 
     func originalURL(for photo: Photo) -> URL {
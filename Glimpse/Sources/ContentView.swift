@@ -26,7 +26,7 @@ struct ContentView: View {
                 photoCount: filteredPhotos.count,
                 onLoadMore: loadMorePhotos,
                 apiClient: viewModel.apiClient,
-                thumbnailURL: { viewModel.apiClient?.thumbnailURL(for: $0) }
+                thumbnailURL: { viewModel.apiClient?.thumbnailURL(for: $0, size: "grid") }
             )
             .frame(minWidth: 400)
         } detail: {
@@ -34,7 +34,7 @@ struct ContentView: View {
                 PhotoDetailView(
                     photo: photo,
                     apiClient: viewModel.apiClient,
-                    thumbnailURL: viewModel.apiClient?.thumbnailURL(for: photo),
+                    thumbnailURL: viewModel.apiClient?.thumbnailURL(for: photo, size: "preview"),
                     streamURL: photo.isVideo ? viewModel.apiClient?.streamURL(for: photo) : nil,
                     onDownload: { downloadPhoto(photo) }
                 )
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const backupPrefix = "glimpse-"
+
+// copyDatabase copies the main database of src into dst with the SQLite
+// online backup API. Readers and writers of src carry on meanwhile, and
+// dst receives a consistent snapshot.
+func copyDatabase(dst, src *sql.DB) error {
+	ctx := context.Background()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return dstConn.Raw(func(dc any) error {
+		return srcConn.Raw(func(sc any) error {
+			b, err := dc.(*sqlite3.SQLiteConn).Backup("main", sc.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			if _, err := b.Step(-1); err != nil {
+				b.Finish()
+				return err
+			}
+			return b.Finish()
+		})
+	})
+}
+
+// Backup writes a consistent snapshot of the database to dest while the
+// server keeps running. The snapshot is checked before it is moved into
+// place.
+func (d *Database) Backup(dest string) error {
+	tmp := dest + ".tmp"
+	os.Remove(tmp)
+
+	snapshot, err := openDatabase(tmp)
+	if err != nil {
+		return err
+	}
+	err = copyDatabase(snapshot.db, d.db)
+	if err == nil {
+		err = snapshot.CheckIntegrity()
+	}
+	// Fold the WAL into the file so the backup is self-contained
+	if err == nil {
+		_, err = snapshot.db.Exec(`PRAGMA journal_mode = DELETE`)
+	}
+	snapshot.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("backup failed: %w", err)
+	}
+	return os.Rename(tmp, dest)
+}
+
+// CheckIntegrity runs SQLite's integrity check.
+func (d *Database) CheckIntegrity() error {
+	rows, err := d.db.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return err
+		}
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check failed: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Restore replaces the contents of the database with a backup, after
+// checking the backup's integrity and that its schema is not newer than
+// this server. The current contents are backed up first. Older schemas are
+// migrated in place.
+func (d *Database) Restore(src string) error {
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	raw, err := sql.Open("sqlite3", "file:"+src+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	backup := &Database{db: raw, path: src}
+	defer backup.Close()
+
+	if err := backup.CheckIntegrity(); err != nil {
+		return fmt.Errorf("backup %s: %w", src, err)
+	}
+	version, err := backup.SchemaVersion()
+	if err != nil {
+		return fmt.Errorf("failed to read backup schema version: %w", err)
+	}
+	if version > latestSchemaVersion() {
+		return fmt.Errorf("backup schema version %d is newer than this server supports (%d)", version, latestSchemaVersion())
+	}
+
+	safety := fmt.Sprintf("%s.pre-restore-%s.bak", d.path, time.Now().Format("20060102-150405"))
+	if err := d.Backup(safety); err != nil {
+		return fmt.Errorf("failed to back up current database: %w", err)
+	}
+	log.Printf("Backed up current database to %s", safety)
+
+	if err := copyDatabase(d.db, backup.db); err != nil {
+		return fmt.Errorf("restore failed: %w", err)
+	}
+	return d.migrate()
+}
+
+// backupName sorts chronologically, so pruning can rely on name order.
+func backupName(t time.Time) string {
+	return backupPrefix + t.Format("20060102-150405") + ".db"
+}
+
+// BackupNow writes a timestamped backup into the configured directory and
+// removes the oldest ones beyond BackupRetention.
+func (d *Database) BackupNow(cfg *Config) (string, error) {
+	if err := os.MkdirAll(cfg.BackupPath, 0755); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	dest := filepath.Join(cfg.BackupPath, backupName(time.Now()))
+	if err := d.Backup(dest); err != nil {
+		return "", err
+	}
+	pruneBackups(cfg.BackupPath, cfg.BackupRetention)
+	return dest, nil
+}
+
+func pruneBackups(dir string, keep int) {
+	matches, err := filepath.Glob(filepath.Join(dir, backupPrefix+"*.db"))
+	if err != nil || len(matches) <= keep {
+		return
+	}
+	sort.Strings(matches)
+	for _, path := range matches[:len(matches)-keep] {
+		if err := os.Remove(path); err != nil {
+			log.Printf("Error removing old backup %s: %v", path, err)
+		}
+	}
+}
+
+// scheduleBackups takes a backup every BackupInterval until the process
+// exits.
+func scheduleBackups(cfg *Config, db *Database) {
+	if cfg.BackupInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cfg.BackupInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		path, err := db.BackupNow(cfg)
+		if err != nil {
+			log.Printf("Scheduled backup error: %v", err)
+			continue
+		}
+		log.Printf("Database backed up to %s", path)
+	}
+}
+
+// runBackup implements `glimpse-server backup [-o file]`. It is safe to run
+// while the server is serving from the same database.
+func runBackup(args []string) error {
+	fs, configPath := commandFlags("backup")
+	output := fs.String("o", "", "Backup file to write (default: a timestamped file in backup_path)")
+	fs.Parse(args)
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	db, err := openDatabase(cfg.DatabasePath)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	path := *output
+	if path == "" {
+		path, err = db.BackupNow(cfg)
+	} else {
+		err = db.Backup(path)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(path)
+	return nil
+}
+
+// runRestore implements `glimpse-server restore <file>`. The server should
+// be stopped first so it does not serve from caches of the old contents.
+func runRestore(args []string) error {
+	fs, configPath := commandFlags("restore")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: glimpse-server restore [-config file] <backup.db>")
+	}
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	db, err := openDatabase(cfg.DatabasePath)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	if err := db.Restore(fs.Arg(0)); err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s into %s\n", fs.Arg(0), cfg.DatabasePath)
+	return nil
+}
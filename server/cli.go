@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// commandFlags returns a flag set for a subcommand with the shared -config
+// flag already defined.
+func commandFlags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to configuration file")
+	return fs, configPath
+}
+
+// openLibrary loads the config and opens the database and a scanner the
+// same way the server does.
+func openLibrary(configPath string) (*Config, *Database, *Scanner, error) {
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	db, err := NewDatabase(cfg.DatabasePath)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	geocoder, err := NewGeocoder(cfg.GazetteerPath, cfg.GeocodeMaxKm)
+	if err != nil {
+		db.Close()
+		return nil, nil, nil, fmt.Errorf("failed to load gazetteer: %w", err)
+	}
+	thumbs := NewThumbnailCache(cfg.ThumbnailCacheMB * 1024 * 1024)
+	return cfg, db, NewScanner(cfg, db, thumbs, geocoder), nil
+}
+
+func runScan(args []string) error {
+	fs, configPath := commandFlags("scan")
+	path := fs.String("path", "", "Only scan this directory, relative to originals_path")
+	force := fs.Bool("force", false, "Reprocess files that are already up to date")
+	fs.Parse(args)
+
+	_, db, scanner, err := openLibrary(*configPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return scanner.ScanPath(*path, *force)
+}
+
+func runRebuildThumbnails(args []string) error {
+	fs, configPath := commandFlags("rebuild-thumbnails")
+	path := fs.String("path", "", "Only rebuild this folder and its subfolders")
+	fs.Parse(args)
+
+	_, db, scanner, err := openLibrary(*configPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	n, err := scanner.Rebuild(*path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rebuilt %d items\n", n)
+	return nil
+}
+
+// runVerify prints a verification report and repairs the categories named
+// by -repair. It fails when problems remain, so cron can alert on it.
+func runVerify(args []string) error {
+	fs, configPath := commandFlags("verify")
+	repair := fs.String("repair", "", "Categories to repair: "+strings.Join(verifyCategories(), ",")+" or all")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	force := fs.Bool("force", false, "Repair missing originals even above cleanup_max_fraction")
+	fs.Parse(args)
+
+	categories, err := parseRepairCategories(*repair)
+	if err != nil {
+		return err
+	}
+
+	_, db, scanner, err := openLibrary(*configPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	report, err := scanner.Verify()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	} else {
+		printVerifyReport(report)
+	}
+
+	if len(categories) > 0 {
+		repairErr := scanner.Repair(report, categories, *force)
+		if report, err = scanner.Verify(); err != nil {
+			return err
+		}
+		if repairErr != nil {
+			fmt.Fprintln(os.Stderr, repairErr)
+		}
+		fmt.Fprintf(os.Stderr, "Repaired %s; %d problems remain\n", strings.Join(categories, ", "), report.Problems())
+	}
+	if n := report.Problems(); n > 0 {
+		return fmt.Errorf("%d problems found", n)
+	}
+	return nil
+}
+
+func printVerifyReport(r *VerifyReport) {
+	fmt.Printf("Checked %d items\n", r.Checked)
+	fmt.Printf("Database integrity: %s\n", r.Integrity)
+
+	section := func(title string, items []string) {
+		fmt.Printf("%s: %d\n", title, len(items))
+		for _, item := range items {
+			fmt.Printf("  %s\n", item)
+		}
+	}
+	section("Missing originals", r.MissingOriginals)
+	section("Changed originals", r.ChangedOriginals)
+	bad := make([]string, len(r.BadThumbnails))
+	for i, t := range r.BadThumbnails {
+		bad[i] = t.Path + " (" + t.Problem + ")"
+	}
+	section("Bad thumbnails", bad)
+	section("Orphan thumbnails", r.OrphanThumbnails)
+}
+
+func runStats(args []string) error {
+	fs, configPath := commandFlags("stats")
+	fs.Parse(args)
+
+	_, db, _, err := openLibrary(*configPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stats, err := db.GetStats()
+	if err != nil {
+		return err
+	}
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Photos:         %d\n", stats.TotalPhotos)
+	fmt.Printf("Videos:         %d\n", stats.TotalVideos)
+	fmt.Printf("Folders:        %d\n", stats.TotalFolders)
+	fmt.Printf("Originals:      %d MB\n", stats.TotalOriginalMB)
+	fmt.Printf("Schema version: %d\n", version)
+	return nil
+}
+
+// runPrune soft-deletes rows whose originals are gone and purges expired
+// ones along with their thumbnails, and trims the image cache, HLS cache and
+// backups to their configured limits.
+func runPrune(args []string) error {
+	fs, configPath := commandFlags("prune")
+	force := fs.Bool("force", false, "Mark missing originals even above cleanup_max_fraction")
+	fs.Parse(args)
+
+	cfg, db, scanner, err := openLibrary(*configPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	scanner.cleanup(*force)
+
+	images, err := NewImageCache(cfg.ImageCachePath, cfg.ImageCacheMB*1024*1024)
+	if err != nil {
+		return err
+	}
+	images.Trim()
+
+	transcoder, err := NewTranscoder(cfg)
+	if err != nil {
+		return err
+	}
+	transcoder.prune()
+
+	pruneBackups(cfg.BackupPath, cfg.BackupRetention)
+
+	if alert := scanner.CleanupAlert(); alert != "" {
+		return errors.New(alert)
+	}
+	return nil
+}
+
+// runImport copies new files from a card or folder into the originals with
+// import_template. Any directory can be given here; import_sources only
+// limits the API. Interrupting stops after the file being copied.
+func runImport(args []string) error {
+	fs, configPath := commandFlags("import")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: glimpse-server import [-config file] <dir>")
+	}
+
+	cfg, db, scanner, err := openLibrary(*configPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	st, err := NewImporter(cfg, scanner).Import(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d copied, %d already imported, %d failed of %d files\n", st.State, st.Copied, st.Skipped, st.Failed, st.Total)
+	for _, e := range st.Errors {
+		fmt.Printf("  %s\n", e)
+	}
+	if st.Failed > 0 {
+		return fmt.Errorf("%d files failed to import", st.Failed)
+	}
+	return nil
+}
+
+func runConfig(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: glimpse-server config init|validate|print [-config file]")
+	}
+	switch args[0] {
+	case "init":
+		return runConfigInit(args[1:])
+	case "validate":
+		return runConfigValidate(args[1:])
+	case "print":
+		return runConfigPrint(args[1:])
+	}
+	return fmt.Errorf("unknown config command %q", args[0])
+}
+
+func runConfigInit(args []string) error {
+	fs, configPath := commandFlags("config init")
+	force := fs.Bool("force", false, "Overwrite an existing file")
+	fs.Parse(args)
+
+	if _, err := os.Stat(*configPath); err == nil && !*force {
+		return fmt.Errorf("%s already exists; use -force to overwrite", *configPath)
+	}
+	if err := DefaultConfig().SaveExample(*configPath); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", *configPath)
+	return nil
+}
+
+// runConfigValidate loads the config as the server would and checks that
+// the paths it names are usable.
+func runConfigValidate(args []string) error {
+	fs, configPath := commandFlags("config validate")
+	fs.Parse(args)
+
+	// LoadConfig falls back to defaults for a missing file
+	if _, err := os.Stat(*configPath); err != nil {
+		return err
+	}
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *configPath, err)
+	}
+	if info, err := os.Stat(cfg.OriginalsPath); err != nil || !info.IsDir() {
+		return fmt.Errorf("originals_path %s is not a directory", cfg.OriginalsPath)
+	}
+	if _, err := NewGeocoder(cfg.GazetteerPath, cfg.GeocodeMaxKm); err != nil {
+		return fmt.Errorf("gazetteer_path: %w", err)
+	}
+	fmt.Printf("%s is valid\n", *configPath)
+	return nil
+}
+
+// runConfigPrint shows the effective settings with defaults filled in.
+// Keys are masked.
+func runConfigPrint(args []string) error {
+	fs, configPath := commandFlags("config print")
+	fs.Parse(args)
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	cj := cfg.fileJSON()
+	if cj.APIKey != "" {
+		cj.APIKey = "********"
+	}
+	cj.APIKeys = append([]APIClient(nil), cj.APIKeys...)
+	for i := range cj.APIKeys {
+		cj.APIKeys[i].Key = "********"
+	}
+
+	data, err := json.MarshalIndent(cj, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -2,32 +2,101 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	OriginalsPath  string        `json:"originals_path"`
-	ThumbnailsPath string        `json:"thumbnails_path"`
-	DatabasePath   string        `json:"database_path"`
-	ListenAddr     string        `json:"listen_addr"`
-	ScanInterval   time.Duration `json:"scan_interval"`
-	ThumbnailSize  int           `json:"thumbnail_size"`
-	RawExtensions   []string      `json:"raw_extensions"`
-	APIKey          string        `json:"api_key"`
-	VideoExtensions []string      `json:"video_extensions"`
+	OriginalsPath       string         `json:"originals_path"`
+	ThumbnailsPath      string         `json:"thumbnails_path"`
+	DatabasePath        string         `json:"database_path"`
+	ListenAddr          string         `json:"listen_addr"`
+	ScanInterval        time.Duration  `json:"scan_interval"`
+	ThumbnailSize       int            `json:"thumbnail_size"`
+	RawExtensions       []string       `json:"raw_extensions"`
+	APIKey              string         `json:"api_key"`
+	VideoExtensions     []string       `json:"video_extensions"`
+	Renditions          []Rendition    `json:"renditions"`
+	DefaultRendition    string         `json:"default_rendition"`
+	ImageCachePath      string         `json:"image_cache_path"`
+	ImageCacheMB        int64          `json:"image_cache_mb"`
+	ThumbnailFormats    []string       `json:"thumbnail_formats"`
+	ThumbnailQuality    int            `json:"thumbnail_quality"`
+	SpriteTileSize      int            `json:"sprite_tile_size"`
+	SpritePageSize      int            `json:"sprite_page_size"`
+	ThumbnailCacheMB    int64          `json:"thumbnail_cache_mb"`
+	VideoPreviewSeconds int            `json:"video_preview_seconds"`
+	ScrubFrames         int            `json:"scrub_frames"`
+	HLSRenditions       []HLSRendition `json:"hls_renditions"`
+	HLSCachePath        string         `json:"hls_cache_path"`
+	HLSCacheMB          int64          `json:"hls_cache_mb"`
+	MaxTranscodes       int            `json:"max_transcodes"`
+	DirectPlayMaxKbps   int            `json:"direct_play_max_kbps"`
+	GazetteerPath       string         `json:"gazetteer_path"`
+	GeocodeMaxKm        float64        `json:"geocode_max_km"`
+	RenditionMetadata   []string       `json:"rendition_metadata"`
+	APIKeys             []APIClient    `json:"api_keys"`
+	HomeZones           []HomeZone     `json:"home_zones"`
+	BackupPath          string         `json:"backup_path"`
+	BackupInterval      time.Duration  `json:"backup_interval"`
+	BackupRetention     int            `json:"backup_retention"`
+	OriginalsSentinel   string         `json:"originals_sentinel"`
+	CleanupMaxFraction  float64        `json:"cleanup_max_fraction"`
+	PurgeAfter          time.Duration  `json:"purge_after"`
+	UploadInbox         string         `json:"upload_inbox"`
+	UploadByDate        bool           `json:"upload_by_date"`
+	UploadTempPath      string         `json:"upload_temp_path"`
+	UploadMaxBytes      int64          `json:"upload_max_bytes"`
+	ImportTemplate      string         `json:"import_template"`
+	ImportSources       []string       `json:"import_sources"`
 }
 
 type configJSON struct {
-	OriginalsPath   string   `json:"originals_path"`
-	ThumbnailsPath  string   `json:"thumbnails_path"`
-	DatabasePath    string   `json:"database_path"`
-	ListenAddr      string   `json:"listen_addr"`
-	ScanIntervalSec int      `json:"scan_interval_seconds"`
-	ThumbnailSize   int      `json:"thumbnail_size"`
-	RawExtensions   []string `json:"raw_extensions"`
-	APIKey          string   `json:"api_key"`
-	VideoExtensions []string `json:"video_extensions"`
+	OriginalsPath       string         `json:"originals_path"`
+	ThumbnailsPath      string         `json:"thumbnails_path"`
+	DatabasePath        string         `json:"database_path"`
+	ListenAddr          string         `json:"listen_addr"`
+	ScanIntervalSec     int            `json:"scan_interval_seconds"`
+	ThumbnailSize       int            `json:"thumbnail_size"`
+	RawExtensions       []string       `json:"raw_extensions"`
+	APIKey              string         `json:"api_key"`
+	VideoExtensions     []string       `json:"video_extensions"`
+	Renditions          []Rendition    `json:"renditions"`
+	DefaultRendition    string         `json:"default_rendition"`
+	ImageCachePath      string         `json:"image_cache_path"`
+	ImageCacheMB        int64          `json:"image_cache_mb"`
+	ThumbnailFormats    []string       `json:"thumbnail_formats"`
+	ThumbnailQuality    int            `json:"thumbnail_quality"`
+	SpriteTileSize      int            `json:"sprite_tile_size"`
+	SpritePageSize      int            `json:"sprite_page_size"`
+	ThumbnailCacheMB    int64          `json:"thumbnail_cache_mb"`
+	VideoPreviewSeconds int            `json:"video_preview_seconds"`
+	ScrubFrames         int            `json:"scrub_frames"`
+	HLSRenditions       []HLSRendition `json:"hls_renditions"`
+	HLSCachePath        string         `json:"hls_cache_path"`
+	HLSCacheMB          int64          `json:"hls_cache_mb"`
+	MaxTranscodes       int            `json:"max_transcodes"`
+	DirectPlayMaxKbps   int            `json:"direct_play_max_kbps"`
+	GazetteerPath       string         `json:"gazetteer_path"`
+	GeocodeMaxKm        float64        `json:"geocode_max_km"`
+	RenditionMetadata   []string       `json:"rendition_metadata"`
+	APIKeys             []APIClient    `json:"api_keys"`
+	HomeZones           []HomeZone     `json:"home_zones"`
+	BackupPath          string         `json:"backup_path"`
+	BackupIntervalHours int            `json:"backup_interval_hours"`
+	BackupRetention     int            `json:"backup_retention"`
+	OriginalsSentinel   string         `json:"originals_sentinel"`
+	CleanupMaxFraction  float64        `json:"cleanup_max_fraction"`
+	PurgeAfterDays      int            `json:"purge_after_days"`
+	UploadInbox         string         `json:"upload_inbox"`
+	UploadByDate        bool           `json:"upload_by_date"`
+	UploadTempPath      string         `json:"upload_temp_path"`
+	UploadMaxBytes      int64          `json:"upload_max_bytes"`
+	ImportTemplate      string         `json:"import_template"`
+	ImportSources       []string       `json:"import_sources"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -46,15 +115,48 @@ func LoadConfig(path string) (*Config, error) {
 	}
 
 	cfg := &Config{
-		OriginalsPath:   cj.OriginalsPath,
-		ThumbnailsPath:  cj.ThumbnailsPath,
-		DatabasePath:    cj.DatabasePath,
-		ListenAddr:      cj.ListenAddr,
-		ScanInterval:    time.Duration(cj.ScanIntervalSec) * time.Second,
-		ThumbnailSize:   cj.ThumbnailSize,
-		RawExtensions:   cj.RawExtensions,
-		APIKey:          cj.APIKey,
-		VideoExtensions: cj.VideoExtensions,
+		OriginalsPath:       cj.OriginalsPath,
+		ThumbnailsPath:      cj.ThumbnailsPath,
+		DatabasePath:        cj.DatabasePath,
+		ListenAddr:          cj.ListenAddr,
+		ScanInterval:        time.Duration(cj.ScanIntervalSec) * time.Second,
+		ThumbnailSize:       cj.ThumbnailSize,
+		RawExtensions:       cj.RawExtensions,
+		APIKey:              cj.APIKey,
+		VideoExtensions:     cj.VideoExtensions,
+		Renditions:          cj.Renditions,
+		DefaultRendition:    cj.DefaultRendition,
+		ImageCachePath:      cj.ImageCachePath,
+		ImageCacheMB:        cj.ImageCacheMB,
+		ThumbnailFormats:    cj.ThumbnailFormats,
+		ThumbnailQuality:    cj.ThumbnailQuality,
+		SpriteTileSize:      cj.SpriteTileSize,
+		SpritePageSize:      cj.SpritePageSize,
+		ThumbnailCacheMB:    cj.ThumbnailCacheMB,
+		VideoPreviewSeconds: cj.VideoPreviewSeconds,
+		ScrubFrames:         cj.ScrubFrames,
+		HLSRenditions:       cj.HLSRenditions,
+		HLSCachePath:        cj.HLSCachePath,
+		HLSCacheMB:          cj.HLSCacheMB,
+		MaxTranscodes:       cj.MaxTranscodes,
+		DirectPlayMaxKbps:   cj.DirectPlayMaxKbps,
+		GazetteerPath:       cj.GazetteerPath,
+		GeocodeMaxKm:        cj.GeocodeMaxKm,
+		RenditionMetadata:   cj.RenditionMetadata,
+		APIKeys:             cj.APIKeys,
+		HomeZones:           cj.HomeZones,
+		BackupPath:          cj.BackupPath,
+		BackupInterval:      time.Duration(cj.BackupIntervalHours) * time.Hour,
+		BackupRetention:     cj.BackupRetention,
+		OriginalsSentinel:   cj.OriginalsSentinel,
+		CleanupMaxFraction:  cj.CleanupMaxFraction,
+		PurgeAfter:          time.Duration(cj.PurgeAfterDays) * 24 * time.Hour,
+		UploadInbox:         cj.UploadInbox,
+		UploadByDate:        cj.UploadByDate,
+		UploadTempPath:      cj.UploadTempPath,
+		UploadMaxBytes:      cj.UploadMaxBytes,
+		ImportTemplate:      cj.ImportTemplate,
+		ImportSources:       cj.ImportSources,
 	}
 
 	// Apply defaults for empty values
@@ -82,20 +184,193 @@ func LoadConfig(path string) (*Config, error) {
 	if len(cfg.VideoExtensions) == 0 {
 		cfg.VideoExtensions = DefaultVideoExtensions()
 	}
+	if len(cfg.Renditions) == 0 {
+		// Without explicit renditions, thumbnail_size keeps sizing "thumb"
+		cfg.Renditions = DefaultRenditions()
+		for i := range cfg.Renditions {
+			if cfg.Renditions[i].Name == "thumb" {
+				cfg.Renditions[i].Size = cfg.ThumbnailSize
+			}
+		}
+	}
+	if cfg.DefaultRendition == "" {
+		cfg.DefaultRendition = "thumb"
+	}
+	if cfg.ImageCachePath == "" {
+		cfg.ImageCachePath = filepath.Join(cfg.ThumbnailsPath, ".image-cache")
+	}
+	if cfg.ImageCacheMB == 0 {
+		cfg.ImageCacheMB = 1024
+	}
+	if len(cfg.ThumbnailFormats) == 0 {
+		cfg.ThumbnailFormats = []string{"jpeg"}
+	}
+	if cfg.ThumbnailQuality == 0 {
+		cfg.ThumbnailQuality = 85
+	}
+	if cfg.SpriteTileSize == 0 {
+		cfg.SpriteTileSize = 160
+	}
+	if cfg.SpritePageSize == 0 {
+		cfg.SpritePageSize = 100
+	}
+	if cfg.ThumbnailCacheMB == 0 {
+		cfg.ThumbnailCacheMB = 256
+	}
+	if cfg.VideoPreviewSeconds == 0 {
+		cfg.VideoPreviewSeconds = 4
+	}
+	if cfg.ScrubFrames == 0 {
+		cfg.ScrubFrames = 20
+	}
+	if len(cfg.HLSRenditions) == 0 {
+		cfg.HLSRenditions = DefaultHLSRenditions()
+	}
+	if cfg.HLSCachePath == "" {
+		cfg.HLSCachePath = filepath.Join(cfg.ThumbnailsPath, ".hls")
+	}
+	if cfg.HLSCacheMB == 0 {
+		cfg.HLSCacheMB = 20480
+	}
+	if cfg.MaxTranscodes == 0 {
+		cfg.MaxTranscodes = 2
+	}
+	if cfg.GeocodeMaxKm == 0 {
+		cfg.GeocodeMaxKm = 50
+	}
+	if cfg.BackupPath == "" {
+		cfg.BackupPath = filepath.Join(filepath.Dir(cfg.DatabasePath), "backups")
+	}
+	// A negative interval disables scheduled backups
+	if cfg.BackupInterval == 0 {
+		cfg.BackupInterval = 24 * time.Hour
+	}
+	if cfg.BackupRetention == 0 {
+		cfg.BackupRetention = 7
+	}
+	if cfg.CleanupMaxFraction == 0 {
+		cfg.CleanupMaxFraction = 0.1
+	}
+	// A negative period purges missing items on the next scan
+	if cfg.PurgeAfter == 0 {
+		cfg.PurgeAfter = 30 * 24 * time.Hour
+	}
+	if cfg.UploadInbox == "" {
+		cfg.UploadInbox = "Inbox"
+	}
+	if cfg.UploadTempPath == "" {
+		cfg.UploadTempPath = filepath.Join(cfg.ThumbnailsPath, ".uploads")
+	}
+	if cfg.UploadMaxBytes == 0 {
+		cfg.UploadMaxBytes = 16 << 30
+	}
+	if cfg.ImportTemplate == "" {
+		cfg.ImportTemplate = DefaultImportTemplate
+	}
+	if len(cfg.RenditionMetadata) == 0 {
+		// Colour profiles affect how renditions look; nothing else is needed
+		cfg.RenditionMetadata = []string{"icc"}
+	}
+	// Anything else fails every preview and retries it on every scan
+	if cfg.VideoPreviewSeconds <= 0 {
+		return nil, fmt.Errorf("video_preview_seconds must be positive")
+	}
+	if cfg.ScrubFrames <= 0 {
+		return nil, fmt.Errorf("scrub_frames must be positive")
+	}
+	if cfg.UploadMaxBytes < 0 {
+		return nil, fmt.Errorf("upload_max_bytes must be positive")
+	}
+	if cfg.BackupRetention < 1 {
+		return nil, fmt.Errorf("backup_retention must be at least 1")
+	}
+	if cfg.CleanupMaxFraction < 0 || cfg.CleanupMaxFraction > 1 {
+		return nil, fmt.Errorf("cleanup_max_fraction must be between 0 and 1")
+	}
+	// Generated files are written and pruned below thumbnails_path
+	if pathWithin(cfg.OriginalsPath, cfg.ThumbnailsPath) || pathWithin(cfg.ThumbnailsPath, cfg.OriginalsPath) {
+		return nil, fmt.Errorf("originals_path and thumbnails_path must not contain each other")
+	}
+	if cfg.OriginalsSentinel != "" && !filepath.IsLocal(cfg.OriginalsSentinel) {
+		return nil, fmt.Errorf("originals_sentinel must be relative to originals_path")
+	}
+	if !filepath.IsLocal(cfg.UploadInbox) || strings.HasPrefix(cfg.UploadInbox, trashDirName) {
+		return nil, fmt.Errorf("upload_inbox must be a folder inside originals_path")
+	}
+	if err := validateImportTemplate(cfg.ImportTemplate); err != nil {
+		return nil, err
+	}
+	for _, dir := range cfg.ImportSources {
+		if !filepath.IsAbs(dir) {
+			return nil, fmt.Errorf("import_sources must be absolute paths, got %q", dir)
+		}
+	}
+	for _, f := range cfg.ThumbnailFormats {
+		if !isImageFormat(f) {
+			return nil, fmt.Errorf("unsupported thumbnail format %q", f)
+		}
+	}
+	if err := cfg.validateRenditions(); err != nil {
+		return nil, err
+	}
+	for _, kind := range cfg.RenditionMetadata {
+		if !isMetadataKind(kind) {
+			return nil, fmt.Errorf("unsupported rendition_metadata %q", kind)
+		}
+	}
+	for _, k := range cfg.APIKeys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("api key %q has no key", k.Name)
+		}
+	}
+	for _, z := range cfg.HomeZones {
+		if z.RadiusM <= 0 {
+			return nil, fmt.Errorf("home zone %q needs a positive radius_m", z.Name)
+		}
+	}
+	if _, ok := cfg.Rendition(cfg.DefaultRendition); !ok {
+		return nil, fmt.Errorf("default_rendition %q is not a configured rendition", cfg.DefaultRendition)
+	}
 
 	return cfg, nil
 }
 
 func DefaultConfig() *Config {
 	return &Config{
-		OriginalsPath:   "/pool/photos/originals",
-		ThumbnailsPath:  "/pool/thumbnails",
-		DatabasePath:    "/pool/thumbnails/glimpse.db",
-		ListenAddr:      ":8080",
-		ScanInterval:    1 * time.Hour,
-		ThumbnailSize:   800,
-		RawExtensions:   DefaultRawExtensions(),
-		VideoExtensions: DefaultVideoExtensions(),
+		OriginalsPath:       "/pool/photos/originals",
+		ThumbnailsPath:      "/pool/thumbnails",
+		DatabasePath:        "/pool/thumbnails/glimpse.db",
+		ListenAddr:          ":8080",
+		ScanInterval:        1 * time.Hour,
+		ThumbnailSize:       800,
+		RawExtensions:       DefaultRawExtensions(),
+		VideoExtensions:     DefaultVideoExtensions(),
+		Renditions:          DefaultRenditions(),
+		DefaultRendition:    "thumb",
+		ImageCachePath:      "/pool/thumbnails/.image-cache",
+		ImageCacheMB:        1024,
+		ThumbnailFormats:    []string{"jpeg"},
+		ThumbnailQuality:    85,
+		SpriteTileSize:      160,
+		SpritePageSize:      100,
+		ThumbnailCacheMB:    256,
+		VideoPreviewSeconds: 4,
+		ScrubFrames:         20,
+		HLSRenditions:       DefaultHLSRenditions(),
+		HLSCachePath:        "/pool/thumbnails/.hls",
+		HLSCacheMB:          20480,
+		MaxTranscodes:       2,
+		GeocodeMaxKm:        50,
+		RenditionMetadata:   []string{"icc"},
+		BackupPath:          "/pool/thumbnails/backups",
+		BackupInterval:      24 * time.Hour,
+		BackupRetention:     7,
+		CleanupMaxFraction:  0.1,
+		PurgeAfter:          30 * 24 * time.Hour,
+		UploadInbox:         "Inbox",
+		UploadTempPath:      "/pool/thumbnails/.uploads",
+		UploadMaxBytes:      16 << 30,
+		ImportTemplate:      DefaultImportTemplate,
 	}
 }
 
@@ -138,22 +413,58 @@ func DefaultVideoExtensions() []string {
 }
 
 func (c *Config) SaveExample(path string) error {
-	cj := configJSON{
-		OriginalsPath:   c.OriginalsPath,
-		ThumbnailsPath:  c.ThumbnailsPath,
-		DatabasePath:    c.DatabasePath,
-		ListenAddr:      c.ListenAddr,
-		ScanIntervalSec: int(c.ScanInterval.Seconds()),
-		ThumbnailSize:   c.ThumbnailSize,
-		RawExtensions:   c.RawExtensions,
-		APIKey:          c.APIKey,
-		VideoExtensions: c.VideoExtensions,
-	}
-
-	data, err := json.MarshalIndent(cj, "", "  ")
+	data, err := json.MarshalIndent(c.fileJSON(), "", "  ")
 	if err != nil {
 		return err
 	}
 
 	return os.WriteFile(path, data, 0644)
 }
+
+// fileJSON converts the config back to its file representation.
+func (c *Config) fileJSON() configJSON {
+	return configJSON{
+		OriginalsPath:       c.OriginalsPath,
+		ThumbnailsPath:      c.ThumbnailsPath,
+		DatabasePath:        c.DatabasePath,
+		ListenAddr:          c.ListenAddr,
+		ScanIntervalSec:     int(c.ScanInterval.Seconds()),
+		ThumbnailSize:       c.ThumbnailSize,
+		RawExtensions:       c.RawExtensions,
+		APIKey:              c.APIKey,
+		VideoExtensions:     c.VideoExtensions,
+		Renditions:          c.Renditions,
+		DefaultRendition:    c.DefaultRendition,
+		ImageCachePath:      c.ImageCachePath,
+		ImageCacheMB:        c.ImageCacheMB,
+		ThumbnailFormats:    c.ThumbnailFormats,
+		ThumbnailQuality:    c.ThumbnailQuality,
+		SpriteTileSize:      c.SpriteTileSize,
+		SpritePageSize:      c.SpritePageSize,
+		ThumbnailCacheMB:    c.ThumbnailCacheMB,
+		VideoPreviewSeconds: c.VideoPreviewSeconds,
+		ScrubFrames:         c.ScrubFrames,
+		HLSRenditions:       c.HLSRenditions,
+		HLSCachePath:        c.HLSCachePath,
+		HLSCacheMB:          c.HLSCacheMB,
+		MaxTranscodes:       c.MaxTranscodes,
+		DirectPlayMaxKbps:   c.DirectPlayMaxKbps,
+		GazetteerPath:       c.GazetteerPath,
+		GeocodeMaxKm:        c.GeocodeMaxKm,
+		RenditionMetadata:   c.RenditionMetadata,
+		APIKeys:             c.APIKeys,
+		HomeZones:           c.HomeZones,
+		BackupPath:          c.BackupPath,
+		BackupIntervalHours: int(c.BackupInterval.Hours()),
+		BackupRetention:     c.BackupRetention,
+		OriginalsSentinel:   c.OriginalsSentinel,
+		CleanupMaxFraction:  c.CleanupMaxFraction,
+		PurgeAfterDays:      int(c.PurgeAfter.Hours() / 24),
+		UploadInbox:         c.UploadInbox,
+		UploadByDate:        c.UploadByDate,
+		UploadTempPath:      c.UploadTempPath,
+		UploadMaxBytes:      c.UploadMaxBytes,
+		ImportTemplate:      c.ImportTemplate,
+		ImportSources:       c.ImportSources,
+	}
+}
@@ -2,28 +2,52 @@ package main
 
 import (
 	"database/sql"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type Photo struct {
-	ID            int64     `json:"id"`
-	OriginalPath  string    `json:"original_path"`
-	ThumbnailPath string    `json:"thumbnail_path"`
-	Folder        string    `json:"folder"`
-	Filename      string    `json:"filename"`
-	Extension     string    `json:"extension"`
-	FileSize      int64     `json:"file_size"`
-	ModTime       time.Time `json:"mod_time"`
-	Width         int       `json:"width,omitempty"`
-	Height        int       `json:"height,omitempty"`
-	CreatedAt     time.Time `json:"created_at"`
-	MediaType     string    `json:"media_type"`
-	Duration      float64   `json:"duration,omitempty"`
-	VideoCodec    string    `json:"video_codec,omitempty"`
-	AudioCodec    string    `json:"audio_codec,omitempty"`
-	Framerate     float64   `json:"framerate,omitempty"`
+	ID            int64      `json:"id"`
+	OriginalPath  string     `json:"original_path"`
+	ThumbnailPath string     `json:"thumbnail_path"`
+	Folder        string     `json:"folder"`
+	Filename      string     `json:"filename"`
+	Extension     string     `json:"extension"`
+	FileSize      int64      `json:"file_size"`
+	ModTime       time.Time  `json:"mod_time"`
+	Width         int        `json:"width,omitempty"`
+	Height        int        `json:"height,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	MediaType     string     `json:"media_type"`
+	Duration      float64    `json:"duration,omitempty"`
+	VideoCodec    string     `json:"video_codec,omitempty"`
+	AudioCodec    string     `json:"audio_codec,omitempty"`
+	Framerate     float64    `json:"framerate,omitempty"`
+	Rotation      int        `json:"rotation,omitempty"`
+	ColorTransfer string     `json:"color_transfer,omitempty"`
+	HDRFormat     string     `json:"hdr_format,omitempty"`
+	Bitrate       int64      `json:"bitrate,omitempty"`
+	CapturedAt    *time.Time `json:"captured_at,omitempty"`
+	Latitude      *float64   `json:"latitude,omitempty"`
+	Longitude     *float64   `json:"longitude,omitempty"`
+	Altitude      *float64   `json:"altitude,omitempty"`
+	CameraMake    string     `json:"camera_make,omitempty"`
+	CameraModel   string     `json:"camera_model,omitempty"`
+	AudioChannels int        `json:"audio_channels,omitempty"`
+	Country       string     `json:"country,omitempty"`
+	Region        string     `json:"region,omitempty"`
+	City          string     `json:"city,omitempty"`
+	Renditions    string     `json:"-"`
+	ThumbHash     string     `json:"thumbhash,omitempty"`
+	AspectRatio   float64    `json:"aspect_ratio,omitempty"`
+	PosterTime    *float64   `json:"poster_time,omitempty"`
+	Geohash       string     `json:"-"`
+	MetadataRead  bool       `json:"-"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+	TrashPath     string     `json:"-"`
+	ContentHash   string     `json:"-"`
 }
 
 type Folder struct {
@@ -32,80 +56,63 @@ type Folder struct {
 }
 
 type Stats struct {
-	TotalPhotos     int   `json:"total_photos"`
-	TotalVideos     int   `json:"total_videos"`
-	TotalFolders    int   `json:"total_folders"`
-	TotalOriginalMB int64 `json:"total_original_mb"`
+	TotalPhotos     int                  `json:"total_photos"`
+	TotalVideos     int                  `json:"total_videos"`
+	TotalFolders    int                  `json:"total_folders"`
+	TotalOriginalMB int64                `json:"total_original_mb"`
+	ThumbnailCache  *ThumbnailCacheStats `json:"thumbnail_cache,omitempty"`
+	TotalTrashed    int                  `json:"total_trashed"`
+	CleanupAlert    string               `json:"cleanup_alert,omitempty"`
 }
 
 type Database struct {
-	db *sql.DB
+	db   *sql.DB
+	path string
 }
 
 func NewDatabase(path string) (*Database, error) {
-	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	d, err := openDatabase(path)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := db.Ping(); err != nil {
-		return nil, err
-	}
-
-	d := &Database{db: db}
 	if err := d.migrate(); err != nil {
+		d.Close()
 		return nil, err
 	}
 
 	return d, nil
 }
 
-func (d *Database) Close() error {
-	return d.db.Close()
-}
-
-func (d *Database) migrate() error {
-	_, err := d.db.Exec(`
-		CREATE TABLE IF NOT EXISTS photos (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			original_path TEXT UNIQUE NOT NULL,
-			thumbnail_path TEXT NOT NULL,
-			folder TEXT NOT NULL,
-			filename TEXT NOT NULL,
-			extension TEXT NOT NULL,
-			file_size INTEGER NOT NULL,
-			mod_time DATETIME NOT NULL,
-			width INTEGER DEFAULT 0,
-			height INTEGER DEFAULT 0,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		);
-
-		CREATE INDEX IF NOT EXISTS idx_photos_folder ON photos(folder);
-		CREATE INDEX IF NOT EXISTS idx_photos_mod_time ON photos(mod_time);
-		CREATE INDEX IF NOT EXISTS idx_photos_filename ON photos(filename);
-	`)
+// openDatabase opens a database without migrating it, for tools that must
+// not change the schema.
+func openDatabase(path string) (*Database, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, stmt := range []string{
-		`ALTER TABLE photos ADD COLUMN media_type TEXT NOT NULL DEFAULT 'photo'`,
-		`ALTER TABLE photos ADD COLUMN duration REAL DEFAULT 0`,
-		`ALTER TABLE photos ADD COLUMN video_codec TEXT DEFAULT ''`,
-		`ALTER TABLE photos ADD COLUMN audio_codec TEXT DEFAULT ''`,
-		`ALTER TABLE photos ADD COLUMN framerate REAL DEFAULT 0`,
-	} {
-		d.db.Exec(stmt)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
 	}
-	d.db.Exec(`CREATE INDEX IF NOT EXISTS idx_photos_media_type ON photos(media_type)`)
 
-	return nil
+	return &Database{db: db, path: path}, nil
+}
+
+func (d *Database) Close() error {
+	return d.db.Close()
 }
 
 func (d *Database) UpsertPhoto(p *Photo) error {
+	p.Geohash = ""
+	if p.Latitude != nil && p.Longitude != nil {
+		p.Geohash = encodeGeohash(*p.Latitude, *p.Longitude, geohashPrecision)
+	}
+
 	_, err := d.db.Exec(`
-		INSERT INTO photos (original_path, thumbnail_path, folder, filename, extension, file_size, mod_time, width, height, media_type, duration, video_codec, audio_codec, framerate)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO photos (original_path, thumbnail_path, folder, filename, extension, file_size, mod_time, width, height, media_type, duration, video_codec, audio_codec, framerate, rotation, color_transfer, hdr_format, bitrate, captured_at, latitude, longitude, altitude, camera_make, camera_model, audio_channels, country, region, city, renditions, thumbhash, aspect_ratio, geohash, metadata_read, content_hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(original_path) DO UPDATE SET
 			thumbnail_path = excluded.thumbnail_path,
 			file_size = excluded.file_size,
@@ -116,16 +123,36 @@ func (d *Database) UpsertPhoto(p *Photo) error {
 			duration = excluded.duration,
 			video_codec = excluded.video_codec,
 			audio_codec = excluded.audio_codec,
-			framerate = excluded.framerate
-	`, p.OriginalPath, p.ThumbnailPath, p.Folder, p.Filename, p.Extension, p.FileSize, p.ModTime, p.Width, p.Height, p.MediaType, p.Duration, p.VideoCodec, p.AudioCodec, p.Framerate)
+			framerate = excluded.framerate,
+			rotation = excluded.rotation,
+			color_transfer = excluded.color_transfer,
+			hdr_format = excluded.hdr_format,
+			bitrate = excluded.bitrate,
+			captured_at = excluded.captured_at,
+			latitude = excluded.latitude,
+			longitude = excluded.longitude,
+			altitude = excluded.altitude,
+			camera_make = excluded.camera_make,
+			camera_model = excluded.camera_model,
+			audio_channels = excluded.audio_channels,
+			country = excluded.country,
+			region = excluded.region,
+			city = excluded.city,
+			renditions = excluded.renditions,
+			thumbhash = excluded.thumbhash,
+			aspect_ratio = excluded.aspect_ratio,
+			geohash = excluded.geohash,
+			metadata_read = excluded.metadata_read,
+			content_hash = excluded.content_hash
+	`, p.OriginalPath, p.ThumbnailPath, p.Folder, p.Filename, p.Extension, p.FileSize, p.ModTime, p.Width, p.Height, p.MediaType, p.Duration, p.VideoCodec, p.AudioCodec, p.Framerate, p.Rotation, p.ColorTransfer, p.HDRFormat, p.Bitrate, p.CapturedAt, p.Latitude, p.Longitude, p.Altitude, p.CameraMake, p.CameraModel, p.AudioChannels, p.Country, p.Region, p.City, p.Renditions, p.ThumbHash, p.AspectRatio, p.Geohash, p.MetadataRead, p.ContentHash)
 	return err
 }
 
-const photoColumns = `id, original_path, thumbnail_path, folder, filename, extension, file_size, mod_time, width, height, created_at, media_type, duration, video_codec, audio_codec, framerate`
+const photoColumns = `id, original_path, thumbnail_path, folder, filename, extension, file_size, mod_time, width, height, created_at, media_type, duration, video_codec, audio_codec, framerate, rotation, color_transfer, hdr_format, bitrate, captured_at, latitude, longitude, altitude, camera_make, camera_model, audio_channels, country, region, city, renditions, thumbhash, aspect_ratio, poster_time, geohash, metadata_read, deleted_at, trash_path, content_hash`
 
 func scanPhoto(scanner interface{ Scan(...any) error }) (*Photo, error) {
 	p := &Photo{}
-	err := scanner.Scan(&p.ID, &p.OriginalPath, &p.ThumbnailPath, &p.Folder, &p.Filename, &p.Extension, &p.FileSize, &p.ModTime, &p.Width, &p.Height, &p.CreatedAt, &p.MediaType, &p.Duration, &p.VideoCodec, &p.AudioCodec, &p.Framerate)
+	err := scanner.Scan(&p.ID, &p.OriginalPath, &p.ThumbnailPath, &p.Folder, &p.Filename, &p.Extension, &p.FileSize, &p.ModTime, &p.Width, &p.Height, &p.CreatedAt, &p.MediaType, &p.Duration, &p.VideoCodec, &p.AudioCodec, &p.Framerate, &p.Rotation, &p.ColorTransfer, &p.HDRFormat, &p.Bitrate, &p.CapturedAt, &p.Latitude, &p.Longitude, &p.Altitude, &p.CameraMake, &p.CameraModel, &p.AudioChannels, &p.Country, &p.Region, &p.City, &p.Renditions, &p.ThumbHash, &p.AspectRatio, &p.PosterTime, &p.Geohash, &p.MetadataRead, &p.DeletedAt, &p.TrashPath, &p.ContentHash)
 	if err != nil {
 		return nil, err
 	}
@@ -136,31 +163,100 @@ func (d *Database) GetPhotoByID(id int64) (*Photo, error) {
 	return scanPhoto(d.db.QueryRow(`SELECT `+photoColumns+` FROM photos WHERE id = ?`, id))
 }
 
+// GetPhotosByIDs returns the photos found among ids, keyed by ID.
+func (d *Database) GetPhotosByIDs(ids []int64) (map[int64]*Photo, error) {
+	photos := make(map[int64]*Photo, len(ids))
+	if len(ids) == 0 {
+		return photos, nil
+	}
+
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.Repeat("?, ", len(ids)-1) + "?"
+
+	rows, err := d.db.Query(`SELECT `+photoColumns+` FROM photos WHERE id IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanPhoto(rows)
+		if err != nil {
+			return nil, err
+		}
+		photos[p.ID] = p
+	}
+	return photos, rows.Err()
+}
+
 func (d *Database) GetPhotoByPath(path string) (*Photo, error) {
 	return scanPhoto(d.db.QueryRow(`SELECT `+photoColumns+` FROM photos WHERE original_path = ?`, path))
 }
 
-func (d *Database) ListPhotos(folder, mediaType string, limit, offset int) ([]*Photo, error) {
-	query := `SELECT ` + photoColumns + ` FROM photos`
+// PhotoFilter narrows listings. Place is a free text match against the
+// country, region and city names. Trash selects deleted items instead of
+// live ones.
+type PhotoFilter struct {
+	Folder    string
+	MediaType string
+	Country   string
+	Region    string
+	City      string
+	Place     string
+	Trash     bool
+}
+
+// hasPlace reports whether the filter selects by location.
+func (f PhotoFilter) hasPlace() bool {
+	return f.Country != "" || f.Region != "" || f.City != "" || f.Place != ""
+}
+
+func (f PhotoFilter) where() (string, []any) {
 	var args []any
-	var conditions []string
+	conditions := []string{`deleted_at IS NULL`}
+	if f.Trash {
+		conditions[0] = `deleted_at IS NOT NULL`
+	}
 
-	if folder != "" {
+	if f.Folder != "" {
 		conditions = append(conditions, `(folder = ? OR folder LIKE ?)`)
-		args = append(args, folder, folder+"/%")
+		args = append(args, f.Folder, f.Folder+"/%")
 	}
-	if mediaType != "" {
+	if f.MediaType != "" {
 		conditions = append(conditions, `media_type = ?`)
-		args = append(args, mediaType)
+		args = append(args, f.MediaType)
+	}
+	if f.Country != "" {
+		conditions = append(conditions, `country = ?`)
+		args = append(args, f.Country)
+	}
+	if f.Region != "" {
+		conditions = append(conditions, `region = ?`)
+		args = append(args, f.Region)
+	}
+	if f.City != "" {
+		conditions = append(conditions, `city = ?`)
+		args = append(args, f.City)
+	}
+	if f.Place != "" {
+		conditions = append(conditions, `(city LIKE ? OR region LIKE ? OR country LIKE ?)`)
+		pattern := "%" + f.Place + "%"
+		args = append(args, pattern, pattern, pattern)
 	}
 
-	if len(conditions) > 0 {
-		query += " WHERE " + conditions[0]
-		for _, c := range conditions[1:] {
-			query += " AND " + c
-		}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func (d *Database) ListPhotos(f PhotoFilter, limit, offset int) ([]*Photo, error) {
+	where, args := f.where()
+	order := `mod_time DESC`
+	if f.Trash {
+		order = `deleted_at DESC`
 	}
-	query += ` ORDER BY mod_time DESC LIMIT ? OFFSET ?`
+	query := `SELECT ` + photoColumns + ` FROM photos` + where + ` ORDER BY ` + order + ` LIMIT ? OFFSET ?`
 	args = append(args, limit, offset)
 
 	rows, err := d.db.Query(query, args...)
@@ -181,10 +277,65 @@ func (d *Database) ListPhotos(folder, mediaType string, limit, offset int) ([]*P
 	return photos, rows.Err()
 }
 
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+type PlaceFacets struct {
+	Countries []FacetCount `json:"countries"`
+	Regions   []FacetCount `json:"regions"`
+	Cities    []FacetCount `json:"cities"`
+}
+
+// PlaceFacets counts the items matching f per country, region and city.
+func (d *Database) PlaceFacets(f PhotoFilter) (*PlaceFacets, error) {
+	facets := &PlaceFacets{}
+	for _, facet := range []struct {
+		column string
+		dst    *[]FacetCount
+	}{
+		{"country", &facets.Countries},
+		{"region", &facets.Regions},
+		{"city", &facets.Cities},
+	} {
+		where, args := f.where()
+		rows, err := d.db.Query(`
+			SELECT `+facet.column+`, COUNT(*) FROM photos`+where+` AND `+facet.column+` != ''
+			GROUP BY `+facet.column+`
+			ORDER BY COUNT(*) DESC, `+facet.column, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		*facet.dst = make([]FacetCount, 0)
+		for rows.Next() {
+			var c FacetCount
+			if err := rows.Scan(&c.Value, &c.Count); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			*facet.dst = append(*facet.dst, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return facets, nil
+}
+
+// PhotosMissingPlace returns geotagged items that have not been matched to
+// a place, such as those indexed before a gazetteer was configured.
+func (d *Database) PhotosMissingPlace() ([]*Photo, error) {
+	return d.queryPhotos(`SELECT ` + photoColumns + ` FROM photos WHERE latitude IS NOT NULL AND country = ''`)
+}
+
 func (d *Database) ListFolders() ([]*Folder, error) {
 	rows, err := d.db.Query(`
 		SELECT folder, COUNT(*) as photo_count
 		FROM photos
+		WHERE deleted_at IS NULL
 		GROUP BY folder
 		ORDER BY folder
 	`)
@@ -208,22 +359,27 @@ func (d *Database) ListFolders() ([]*Folder, error) {
 func (d *Database) GetStats() (*Stats, error) {
 	s := &Stats{}
 
-	err := d.db.QueryRow(`SELECT COUNT(*) FROM photos WHERE media_type = 'photo'`).Scan(&s.TotalPhotos)
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM photos WHERE deleted_at IS NULL AND media_type = 'photo'`).Scan(&s.TotalPhotos)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.db.QueryRow(`SELECT COUNT(*) FROM photos WHERE deleted_at IS NULL AND media_type = 'video'`).Scan(&s.TotalVideos)
 	if err != nil {
 		return nil, err
 	}
 
-	err = d.db.QueryRow(`SELECT COUNT(*) FROM photos WHERE media_type = 'video'`).Scan(&s.TotalVideos)
+	err = d.db.QueryRow(`SELECT COUNT(DISTINCT folder) FROM photos WHERE deleted_at IS NULL`).Scan(&s.TotalFolders)
 	if err != nil {
 		return nil, err
 	}
 
-	err = d.db.QueryRow(`SELECT COUNT(DISTINCT folder) FROM photos`).Scan(&s.TotalFolders)
+	err = d.db.QueryRow(`SELECT COALESCE(SUM(file_size), 0) / 1048576 FROM photos WHERE deleted_at IS NULL`).Scan(&s.TotalOriginalMB)
 	if err != nil {
 		return nil, err
 	}
 
-	err = d.db.QueryRow(`SELECT COALESCE(SUM(file_size), 0) / 1048576 FROM photos`).Scan(&s.TotalOriginalMB)
+	err = d.db.QueryRow(`SELECT COUNT(*) FROM photos WHERE deleted_at IS NOT NULL`).Scan(&s.TotalTrashed)
 	if err != nil {
 		return nil, err
 	}
@@ -231,36 +387,232 @@ func (d *Database) GetStats() (*Stats, error) {
 	return s, nil
 }
 
-func (d *Database) PhotoExists(path string, modTime time.Time) (bool, error) {
+// PhotoExists reports whether path is indexed at modTime with thumbnails for
+// the given rendition signature.
+func (d *Database) PhotoExists(path string, modTime time.Time, renditions string) (bool, error) {
 	var count int
 	err := d.db.QueryRow(`
-		SELECT COUNT(*) FROM photos WHERE original_path = ? AND mod_time = ?
-	`, path, modTime).Scan(&count)
+		SELECT COUNT(*) FROM photos WHERE original_path = ? AND mod_time = ? AND renditions = ?
+	`, path, modTime, renditions).Scan(&count)
 	if err != nil {
 		return false, err
 	}
 	return count > 0, nil
 }
 
+// PhotosMissingPlaceholder returns live rows without a ThumbHash. Trashed
+// rows are left alone, since their thumbnails may be gone.
+func (d *Database) PhotosMissingPlaceholder() ([]*Photo, error) {
+	return d.queryPhotos(`SELECT ` + photoColumns + ` FROM photos WHERE thumbhash = '' AND deleted_at IS NULL`)
+}
+
+// VideosMissingMetadata returns live videos that have not been probed
+// since their metadata was last invalidated.
+func (d *Database) VideosMissingMetadata() ([]*Photo, error) {
+	return d.queryPhotos(`SELECT ` + photoColumns + ` FROM photos WHERE media_type = 'video' AND metadata_read = 0 AND deleted_at IS NULL`)
+}
+
+// PhotosMissingLocation returns live photos whose EXIF has not been read
+// yet and live rows with coordinates recorded before geohashes were stored.
+func (d *Database) PhotosMissingLocation() ([]*Photo, error) {
+	return d.queryPhotos(`SELECT ` + photoColumns + ` FROM photos WHERE deleted_at IS NULL AND ((media_type = 'photo' AND metadata_read = 0) OR (latitude IS NOT NULL AND geohash = ''))`)
+}
+
+// MapClusters groups live geotagged items in bbox by geohash cell, leaving
+// out those inside any of the exclude boxes.
+func (d *Database) MapClusters(bbox *BBox, precision int, exclude []*BBox) ([]*MapCluster, error) {
+	query := `
+		SELECT substr(geohash, 1, ?) AS cell, COUNT(*), AVG(latitude), AVG(longitude), id, MAX(mod_time)
+		FROM photos
+		WHERE deleted_at IS NULL AND geohash != '' AND latitude BETWEEN ? AND ?`
+	args := []any{precision, bbox.MinLat, bbox.MaxLat}
+
+	if bbox.MinLon <= bbox.MaxLon {
+		query += ` AND longitude BETWEEN ? AND ?`
+		args = append(args, bbox.MinLon, bbox.MaxLon)
+
+		// Narrow to the geohash range shared by the corners so the index is used
+		prefix := commonPrefix(
+			encodeGeohash(bbox.MinLat, bbox.MinLon, geohashPrecision),
+			encodeGeohash(bbox.MaxLat, bbox.MaxLon, geohashPrecision),
+		)
+		if prefix != "" {
+			query += ` AND geohash >= ? AND geohash < ?`
+			args = append(args, prefix, prefix+"~")
+		}
+	} else {
+		query += ` AND (longitude >= ? OR longitude <= ?)`
+		args = append(args, bbox.MinLon, bbox.MaxLon)
+	}
+	for _, b := range exclude {
+		query += ` AND NOT (latitude BETWEEN ? AND ? AND longitude BETWEEN ? AND ?)`
+		args = append(args, b.MinLat, b.MaxLat, b.MinLon, b.MaxLon)
+	}
+	query += ` GROUP BY cell ORDER BY COUNT(*) DESC`
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clusters []*MapCluster
+	for rows.Next() {
+		c := &MapCluster{}
+		var modTime any
+		if err := rows.Scan(&c.Geohash, &c.Count, &c.Latitude, &c.Longitude, &c.PhotoID, &modTime); err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, c)
+	}
+	return clusters, rows.Err()
+}
+
+// GeotaggedIn returns each live geotagged item inside box as a cluster of
+// one.
+func (d *Database) GeotaggedIn(box *BBox) ([]*MapCluster, error) {
+	rows, err := d.db.Query(`
+		SELECT id, latitude, longitude FROM photos
+		WHERE deleted_at IS NULL AND geohash != ''
+			AND latitude BETWEEN ? AND ? AND longitude BETWEEN ? AND ?`,
+		box.MinLat, box.MaxLat, box.MinLon, box.MaxLon)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []*MapCluster
+	for rows.Next() {
+		p := &MapCluster{Count: 1}
+		if err := rows.Scan(&p.PhotoID, &p.Latitude, &p.Longitude); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+func (d *Database) queryPhotos(query string, args ...any) ([]*Photo, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var photos []*Photo
+	for rows.Next() {
+		p, err := scanPhoto(rows)
+		if err != nil {
+			return nil, err
+		}
+		photos = append(photos, p)
+	}
+	return photos, rows.Err()
+}
+
+func (d *Database) SetPlaceholder(id int64, thumbHash string, aspectRatio float64) error {
+	_, err := d.db.Exec(`UPDATE photos SET thumbhash = ?, aspect_ratio = ? WHERE id = ?`, thumbHash, aspectRatio, id)
+	return err
+}
+
+// SetPosterTime stores a manually chosen poster frame time for a video.
+// A nil time returns the video to automatic selection.
+func (d *Database) SetPosterTime(id int64, t *float64) error {
+	_, err := d.db.Exec(`UPDATE photos SET poster_time = ? WHERE id = ?`, t, id)
+	return err
+}
+
+// SetPreviewError records why a video's previews could not be generated,
+// or clears it with "". Videos with an error are not retried until their
+// file changes.
+func (d *Database) SetPreviewError(path, msg string) error {
+	_, err := d.db.Exec(`UPDATE photos SET preview_error = ? WHERE original_path = ?`, msg, path)
+	return err
+}
+
+// VideosWithoutPreviewError returns the live videos whose previews have not
+// failed, the candidates for a preview backfill.
+func (d *Database) VideosWithoutPreviewError() ([]*Photo, error) {
+	return d.queryPhotos(`SELECT ` + photoColumns + ` FROM photos WHERE media_type = 'video' AND preview_error = '' AND deleted_at IS NULL`)
+}
+
+// PhotosBySize returns the live items whose originals are size bytes, the
+// candidates for a duplicate of a file that size.
+func (d *Database) PhotosBySize(size int64) ([]*Photo, error) {
+	return d.queryPhotos(`SELECT `+photoColumns+` FROM photos WHERE file_size = ? AND deleted_at IS NULL`, size)
+}
+
+func (d *Database) SetContentHash(id int64, hash string) error {
+	_, err := d.db.Exec(`UPDATE photos SET content_hash = ? WHERE id = ?`, hash, id)
+	return err
+}
+
 func (d *Database) DeletePhoto(path string) error {
 	_, err := d.db.Exec(`DELETE FROM photos WHERE original_path = ?`, path)
 	return err
 }
 
-func (d *Database) AllOriginalPaths() ([]struct{ OriginalPath, ThumbnailPath string }, error) {
-	rows, err := d.db.Query(`SELECT original_path, thumbnail_path FROM photos`)
+// IndexedPath is the part of a row cleanup needs.
+type IndexedPath struct {
+	OriginalPath  string
+	ThumbnailPath string
+	DeletedAt     *time.Time
+	TrashPath     string
+}
+
+func (d *Database) AllOriginalPaths() ([]IndexedPath, error) {
+	return d.queryPaths(`SELECT original_path, thumbnail_path, deleted_at, trash_path FROM photos`)
+}
+
+// DeletedBefore returns soft-deleted rows whose deletion is older than t.
+func (d *Database) DeletedBefore(t time.Time) ([]IndexedPath, error) {
+	return d.queryPaths(`SELECT original_path, thumbnail_path, deleted_at, trash_path FROM photos WHERE deleted_at < ?`, t)
+}
+
+func (d *Database) queryPaths(query string, args ...any) ([]IndexedPath, error) {
+	rows, err := d.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var paths []struct{ OriginalPath, ThumbnailPath string }
+	var paths []IndexedPath
 	for rows.Next() {
-		var p struct{ OriginalPath, ThumbnailPath string }
-		if err := rows.Scan(&p.OriginalPath, &p.ThumbnailPath); err != nil {
+		var p IndexedPath
+		if err := rows.Scan(&p.OriginalPath, &p.ThumbnailPath, &p.DeletedAt, &p.TrashPath); err != nil {
 			return nil, err
 		}
 		paths = append(paths, p)
 	}
 	return paths, rows.Err()
 }
+
+// SetDeleted soft-deletes the row for path at t, or undeletes it when t is
+// nil. trashPath is where the original was moved to, if anywhere.
+func (d *Database) SetDeleted(path string, t *time.Time, trashPath string) error {
+	_, err := d.db.Exec(`UPDATE photos SET deleted_at = ?, trash_path = ? WHERE original_path = ?`, t, trashPath, path)
+	return err
+}
+
+// AllPhotos returns every row, including those in the trash.
+func (d *Database) AllPhotos() ([]*Photo, error) {
+	return d.queryPhotos(`SELECT ` + photoColumns + ` FROM photos`)
+}
+
+// Relocate points the rows at oldPaths to the paths of the matching photos
+// after their originals were moved, in one transaction.
+func (d *Database) Relocate(oldPaths []string, photos []*Photo) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, p := range photos {
+		if _, err := tx.Exec(`UPDATE photos SET original_path = ?, thumbnail_path = ?, folder = ?, filename = ? WHERE original_path = ?`,
+			p.OriginalPath, p.ThumbnailPath, p.Folder, p.Filename, oldPaths[i]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// manifestName is the archive entry describing a download. It is claimed
+// first so no photo can take its name.
+const manifestName = "manifest.json"
+
+// ArchiveEntry describes one file in a download's manifest. Sidecars have
+// no ID.
+type ArchiveEntry struct {
+	Name       string     `json:"name"`
+	ID         int64      `json:"id,omitempty"`
+	Path       string     `json:"path"` // relative to originals_path
+	Size       int64      `json:"size"`
+	Modified   time.Time  `json:"modified"`
+	CapturedAt *time.Time `json:"captured_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// ArchiveManifest is written as manifest.json at the end of an archive.
+// Entries that could not be read keep their error and are not in the
+// archive.
+type ArchiveManifest struct {
+	Created time.Time      `json:"created"`
+	Folder  string         `json:"folder,omitempty"`
+	Entries []ArchiveEntry `json:"entries"`
+}
+
+// archiveItem is a file to add, with the name it has in the archive.
+type archiveItem struct {
+	name  string
+	path  string
+	photo *Photo
+}
+
+// archivePlan lays out the archive before anything is written. Names are
+// unique ignoring case, since archives are mostly unpacked on macOS, and
+// sidecars take on their photo's name when it had to be changed.
+type archivePlan struct {
+	root  string
+	items []archiveItem
+	names map[string]bool
+	paths map[string]bool
+}
+
+func newArchivePlan(root string) *archivePlan {
+	return &archivePlan{root: root, names: map[string]bool{manifestName: true}, paths: make(map[string]bool)}
+}
+
+// add places file under name, which may include slash separated folders,
+// and returns the name it got, or "" if file is already in the archive.
+func (a *archivePlan) add(name, file string, photo *Photo) string {
+	if a.paths[file] {
+		return ""
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for n := 1; a.names[strings.ToLower(name)]; n++ {
+		name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+	a.names[strings.ToLower(name)] = true
+	a.paths[file] = true
+	a.items = append(a.items, archiveItem{name, file, photo})
+	return name
+}
+
+// addPhoto places a photo and, if sidecars is set, the companion files that
+// are not indexed themselves, renamed to match if the photo was.
+func (a *archivePlan) addPhoto(db *Database, p *Photo, name string, sidecars bool) {
+	got := a.add(name, p.OriginalPath, p)
+	if got == "" || !sidecars {
+		return
+	}
+	dir := path.Dir(got)
+	for _, c := range companionFiles(p.OriginalPath) {
+		if _, err := db.GetPhotoByPath(c); err == nil {
+			continue
+		}
+		a.add(path.Join(dir, companionName(c, filepath.Base(p.OriginalPath), path.Base(got))), c, nil)
+	}
+}
+
+// writeArchive streams the planned files as an uncompressed ZIP, since
+// photos and videos are already compressed. archive/zip switches to ZIP64
+// for entries and archives past 4 GB. Files that fail to open are recorded
+// in the manifest; a failed write means the client went away.
+func (a *archivePlan) writeArchive(w io.Writer, manifest *ArchiveManifest) error {
+	zw := zip.NewWriter(w)
+	for _, item := range a.items {
+		entry := ArchiveEntry{Name: item.name, Path: item.path}
+		if rel, err := filepath.Rel(a.root, item.path); err == nil {
+			entry.Path = filepath.ToSlash(rel)
+		}
+		if item.photo != nil {
+			entry.ID, entry.CapturedAt = item.photo.ID, item.photo.CapturedAt
+		}
+		if err := addArchiveFile(zw, item, &entry); err != nil {
+			if entry.Error == "" {
+				return err
+			}
+			log.Printf("Error adding %s to download: %s", item.path, entry.Error)
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: manifestName, Method: zip.Store, Modified: manifest.Created})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// addArchiveFile copies one file into the archive. Problems with the file
+// itself are reported through entry.Error.
+func addArchiveFile(zw *zip.Writer, item archiveItem, entry *ArchiveEntry) error {
+	f, err := os.Open(item.path)
+	if err != nil {
+		entry.Error = err.Error()
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		entry.Error = err.Error()
+		return err
+	}
+	entry.Size, entry.Modified = info.Size(), info.ModTime()
+
+	fh := &zip.FileHeader{Name: item.name, Method: zip.Store, Modified: info.ModTime()}
+	fh.SetMode(info.Mode().Perm())
+	fw, err := zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, f)
+	return err
+}
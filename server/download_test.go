@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestArchivePlanAdd(t *testing.T) {
+	a := newArchivePlan("/photos")
+	steps := []struct {
+		name, file string
+		want       string
+	}{
+		{"trip/IMG_1.jpg", "/photos/trip/IMG_1.jpg", "trip/IMG_1.jpg"},
+		{"trip/IMG_1.jpg", "/photos/other/IMG_1.jpg", "trip/IMG_1 (1).jpg"},
+		{"trip/img_1.JPG", "/photos/third/img_1.JPG", "trip/img_1 (2).JPG"},
+		{"trip/IMG_1 (3).jpg", "/photos/trip/IMG_1 (3).jpg", "trip/IMG_1 (3).jpg"},
+		{"trip/IMG_1.jpg", "/photos/fourth/IMG_1.jpg", "trip/IMG_1 (4).jpg"},
+		{"trip/IMG_1.jpg", "/photos/trip/IMG_1.jpg", ""},
+		{"manifest.json", "/photos/manifest.json", "manifest (1).json"},
+		{"Makefile", "/photos/a/Makefile", "Makefile"},
+		{"Makefile", "/photos/b/Makefile", "Makefile (1)"},
+	}
+	for _, s := range steps {
+		if got := a.add(s.name, s.file, nil); got != s.want {
+			t.Errorf("add(%q, %q) = %q, want %q", s.name, s.file, got, s.want)
+		}
+	}
+	if len(a.items) != len(steps)-1 {
+		t.Errorf("planned %d items, want %d", len(a.items), len(steps)-1)
+	}
+}
+
+func TestArchivePlanAddPhotoRenamesSidecars(t *testing.T) {
+	root := t.TempDir()
+	db, err := NewDatabase(filepath.Join(t.TempDir(), "photos.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var photos []*Photo
+	for _, folder := range []string{"a", "b"} {
+		dir := filepath.Join(root, folder)
+		os.MkdirAll(dir, 0755)
+		for _, name := range []string{"IMG_1.jpg", "IMG_1.xmp", "IMG_1.jpg.json"} {
+			if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		photos = append(photos, &Photo{OriginalPath: filepath.Join(dir, "IMG_1.jpg")})
+	}
+
+	a := newArchivePlan(root)
+	for _, p := range photos {
+		a.addPhoto(db, p, "IMG_1.jpg", true)
+	}
+	var names []string
+	for _, item := range a.items {
+		names = append(names, item.name)
+	}
+	slices.Sort(names)
+	want := []string{
+		"IMG_1 (1).jpg", "IMG_1 (1).jpg.json", "IMG_1 (1).xmp",
+		"IMG_1.jpg", "IMG_1.jpg.json", "IMG_1.xmp",
+	}
+	if !slices.Equal(names, want) {
+		t.Errorf("got %q, want %q", names, want)
+	}
+}
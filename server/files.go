@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+var (
+	errPathEscapes   = errors.New("path is outside the originals directory")
+	errPathExists    = errors.New("destination already exists")
+	errInvalidName   = errors.New("invalid file name")
+	errExtension     = errors.New("renaming cannot change the file extension")
+	errNotFolder     = errors.New("folder not found")
+	errScanRunning   = errors.New("a scan is running; try again shortly")
+	errMoveIntoSelf  = errors.New("cannot move a folder into itself")
+	errCrossFilesys  = errors.New("cannot move a folder across filesystems")
+	errOriginalsRoot = errors.New("cannot move the originals directory")
+)
+
+// resolveOriginal turns a slash separated path relative to OriginalsPath
+// into an absolute one. Paths that climb out of the root, through ".." or
+// a symlink, and paths inside the trash are rejected. "" is the root.
+func (s *Scanner) resolveOriginal(rel string) (string, error) {
+	rel = filepath.FromSlash(strings.Trim(rel, "/"))
+	if rel == "" {
+		return s.cfg.OriginalsPath, nil
+	}
+	if !filepath.IsLocal(rel) || strings.SplitN(rel, string(filepath.Separator), 2)[0] == trashDirName {
+		return "", errPathEscapes
+	}
+	abs := filepath.Join(s.cfg.OriginalsPath, rel)
+
+	// Resolve the deepest existing ancestor so a symlinked directory cannot
+	// lead outside the root
+	root, err := filepath.EvalSymlinks(s.cfg.OriginalsPath)
+	if err != nil {
+		return "", err
+	}
+	existing := abs
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	if real != root && !strings.HasPrefix(real, root+string(filepath.Separator)) {
+		return "", errPathEscapes
+	}
+	return abs, nil
+}
+
+// companionFiles lists the files that belong with path: the same name with
+// another extension, such as the JPEG of a RAW pair or a Live Photo video,
+// and sidecars named after the whole file, such as IMG_1.CR2.xmp.
+func companionFiles(path string) []string {
+	dir, name := filepath.Split(path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var files []string
+	for _, e := range entries {
+		n := e.Name()
+		if e.IsDir() {
+			continue
+		}
+		if isCompanion(n, name) {
+			files = append(files, filepath.Join(dir, n))
+		}
+	}
+	return files
+}
+
+// isCompanion reports whether the file n, in the same folder, belongs with
+// name.
+func isCompanion(n, name string) bool {
+	s := strings.TrimSuffix(n, filepath.Ext(n))
+	return n != name && (s == strings.TrimSuffix(name, filepath.Ext(name)) || s == name)
+}
+
+// companionName renames a companion of oldName to go with newName.
+func companionName(companion, oldName, newName string) string {
+	n := filepath.Base(companion)
+	if strings.TrimSuffix(n, filepath.Ext(n)) == oldName {
+		return newName + filepath.Ext(n)
+	}
+	return strings.TrimSuffix(newName, filepath.Ext(newName)) + filepath.Ext(n)
+}
+
+type fileMove struct {
+	src, dst string
+}
+
+// MovePhoto renames an item to name inside folder, relative to the
+// originals, taking its companions along. Rows and thumbnails of every
+// moved file that is indexed follow it.
+func (s *Scanner) MovePhoto(p *Photo, folder, name string) error {
+	if !s.mu.TryLock() {
+		return errScanRunning
+	}
+	defer s.unlock()
+
+	oldName := filepath.Base(p.OriginalPath)
+	if name == "" {
+		name = oldName
+	}
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return errInvalidName
+	}
+	if !strings.EqualFold(filepath.Ext(name), filepath.Ext(oldName)) {
+		return errExtension
+	}
+	dir, err := s.resolveOriginal(folder)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return errNotFolder
+	}
+
+	moves := []fileMove{{p.OriginalPath, filepath.Join(dir, name)}}
+	if moves[0].src == moves[0].dst {
+		return nil
+	}
+	for _, c := range companionFiles(p.OriginalPath) {
+		moves = append(moves, fileMove{c, filepath.Join(dir, companionName(c, oldName, name))})
+	}
+	for _, m := range moves {
+		// A case-only rename finds the source itself on case-insensitive filesystems
+		dstInfo, err := os.Lstat(m.dst)
+		if err != nil {
+			continue
+		}
+		if srcInfo, err := os.Lstat(m.src); err != nil || !os.SameFile(srcInfo, dstInfo) {
+			return fmt.Errorf("%w: %s", errPathExists, filepath.Base(m.dst))
+		}
+	}
+	if err := s.checkIndexed(moves); err != nil {
+		return err
+	}
+
+	for i, m := range moves {
+		if err := moveFile(m.src, m.dst); err != nil {
+			// Put back what was already moved so the group stays together
+			for _, done := range moves[:i] {
+				moveFile(done.dst, done.src)
+			}
+			return err
+		}
+	}
+	return s.relocate(moves)
+}
+
+// checkIndexed fails if a row, trashed or not, already holds the
+// destination of a move. Moving onto it would break the unique path of the
+// index after the files had been moved.
+func (s *Scanner) checkIndexed(moves []fileMove) error {
+	for _, m := range moves {
+		if _, err := s.db.GetPhotoByPath(m.dst); err == nil {
+			return fmt.Errorf("%w in the index: %s", errPathExists, filepath.Base(m.dst))
+		}
+	}
+	return nil
+}
+
+// relocate updates the rows and moves the thumbnails of indexed files that
+// were moved on disk.
+func (s *Scanner) relocate(moves []fileMove) error {
+	var updates []*Photo
+	var oldPaths []string
+	for _, m := range moves {
+		p, err := s.db.GetPhotoByPath(m.src)
+		if err != nil {
+			continue
+		}
+		s.moveThumbnails(p, m.dst)
+		oldPaths = append(oldPaths, m.src)
+		updates = append(updates, s.movedPhoto(p, m.dst))
+	}
+	if err := s.db.Relocate(oldPaths, updates); err != nil {
+		return fmt.Errorf("files were moved but the index was not updated: %w", err)
+	}
+	for _, path := range oldPaths {
+		s.thumbs.Invalidate(path)
+	}
+	return nil
+}
+
+// movedPhoto returns p with the path fields describing newPath.
+func (s *Scanner) movedPhoto(p *Photo, newPath string) *Photo {
+	moved := *p
+	moved.OriginalPath = newPath
+	moved.Filename = filepath.Base(newPath)
+	moved.Folder = ""
+	if rel, err := filepath.Rel(s.cfg.OriginalsPath, filepath.Dir(newPath)); err == nil && rel != "." {
+		moved.Folder = filepath.ToSlash(rel)
+	}
+	moved.ThumbnailPath, _ = s.cfg.RenditionPath(newPath, s.cfg.DefaultRendition, s.cfg.PrimaryFormat())
+	for _, r := range s.cfg.Renditions {
+		old, _ := s.cfg.RenditionPath(p.OriginalPath, r.Name, formatFromPath(p.ThumbnailPath))
+		if old == p.ThumbnailPath {
+			moved.ThumbnailPath, _ = s.cfg.RenditionPath(newPath, r.Name, formatFromPath(p.ThumbnailPath))
+		}
+	}
+	return &moved
+}
+
+// moveThumbnails renames every generated file of p to follow its original
+// to newPath.
+func (s *Scanner) moveThumbnails(p *Photo, newPath string) {
+	isVideo := p.MediaType == "video"
+	oldPaths, newPaths := s.derivedPaths(p.OriginalPath, isVideo), s.derivedPaths(newPath, isVideo)
+	for i, old := range oldPaths {
+		if _, err := os.Stat(old); err != nil {
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(newPaths[i]), 0755)
+		if err == nil {
+			err = os.Rename(old, newPaths[i])
+		}
+		if err != nil {
+			log.Printf("Error moving thumbnail %s: %v", old, err)
+		}
+	}
+}
+
+// MoveFolder moves or renames a folder, both relative to the originals.
+// Every row below it is updated in a single transaction and the matching
+// thumbnail directories are moved alongside.
+func (s *Scanner) MoveFolder(from, to string) error {
+	if !s.mu.TryLock() {
+		return errScanRunning
+	}
+	defer s.unlock()
+
+	src, err := s.resolveOriginal(from)
+	if err != nil {
+		return err
+	}
+	dst, err := s.resolveOriginal(to)
+	if err != nil {
+		return err
+	}
+	if src == s.cfg.OriginalsPath || dst == s.cfg.OriginalsPath {
+		return errOriginalsRoot
+	}
+	if strings.HasPrefix(dst, src+string(filepath.Separator)) {
+		return errMoveIntoSelf
+	}
+	if info, err := os.Stat(src); err != nil || !info.IsDir() {
+		return errNotFolder
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return errPathExists
+	}
+
+	srcRel, _ := filepath.Rel(s.cfg.OriginalsPath, src)
+	dstRel, _ := filepath.Rel(s.cfg.OriginalsPath, dst)
+	photos, err := s.db.ListPhotos(PhotoFilter{Folder: filepath.ToSlash(srcRel)}, -1, 0)
+	if err != nil {
+		return err
+	}
+	trashed, err := s.db.ListPhotos(PhotoFilter{Folder: filepath.ToSlash(srcRel), Trash: true}, -1, 0)
+	if err != nil {
+		return err
+	}
+	moves := []fileMove{{src, dst}}
+	var oldPaths []string
+	var updates []*Photo
+	for _, p := range append(photos, trashed...) {
+		// The folder filter uses LIKE, so check the match is really below src
+		rel, err := filepath.Rel(src, p.OriginalPath)
+		if err != nil || !filepath.IsLocal(rel) {
+			continue
+		}
+		moves = append(moves, fileMove{p.OriginalPath, filepath.Join(dst, rel)})
+		oldPaths = append(oldPaths, p.OriginalPath)
+		updates = append(updates, s.movedPhoto(p, filepath.Join(dst, rel)))
+	}
+	if err := s.checkIndexed(moves); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		if errors.Is(err, syscall.EXDEV) {
+			return errCrossFilesys
+		}
+		return err
+	}
+
+	for _, dir := range s.generatedDirs() {
+		old := filepath.Join(dir, srcRel)
+		if _, err := os.Stat(old); err != nil {
+			continue
+		}
+		err := os.MkdirAll(filepath.Join(dir, filepath.Dir(dstRel)), 0755)
+		if err == nil {
+			err = os.Rename(old, filepath.Join(dir, dstRel))
+		}
+		if err != nil {
+			log.Printf("Error moving thumbnails %s: %v", old, err)
+		}
+	}
+
+	if err := s.db.Relocate(oldPaths, updates); err != nil {
+		return fmt.Errorf("folder was moved but the index was not updated: %w", err)
+	}
+	for _, path := range oldPaths {
+		s.thumbs.Invalidate(path)
+	}
+	return nil
+}
+
+// CreateFolder creates a folder, and any missing parents, relative to the
+// originals.
+func (s *Scanner) CreateFolder(rel string) error {
+	dir, err := s.resolveOriginal(rel)
+	if err != nil {
+		return err
+	}
+	if dir == s.cfg.OriginalsPath {
+		return errPathExists
+	}
+	if _, err := os.Lstat(dir); err == nil {
+		return errPathExists
+	}
+	return os.MkdirAll(dir, 0755)
+}
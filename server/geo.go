@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohashPrecision is the stored geohash length, about 4 cm at the
+// equator, so clustering can truncate to any coarser cell.
+const geohashPrecision = 12
+
+func encodeGeohash(lat, lon float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+
+	var b strings.Builder
+	bit, ch, even := 0, 0, true
+	for b.Len() < precision {
+		rng, v := &latRange, lat
+		if even {
+			rng, v = &lonRange, lon
+		}
+		mid := (rng[0] + rng[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			rng[0] = mid
+		} else {
+			rng[1] = mid
+		}
+		even = !even
+
+		if bit++; bit == 5 {
+			b.WriteByte(geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return b.String()
+}
+
+// clusterPrecision maps a web map zoom level to the geohash length used to
+// group markers, giving a handful of clusters per screen at any zoom.
+func clusterPrecision(zoom int) int {
+	return min(9, max(1, (zoom+2)/2))
+}
+
+// commonPrefix returns the shared prefix of two strings, used to narrow map
+// queries to a geohash range the index can serve.
+func commonPrefix(a, b string) string {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return a[:i]
+		}
+	}
+	return a[:n]
+}
+
+// BBox is a map viewport in degrees. MinLon may exceed MaxLon when the box
+// crosses the antimeridian.
+type BBox struct {
+	MinLon, MinLat, MaxLon, MaxLat float64
+}
+
+func ParseBBox(s string) (*BBox, error) {
+	var b BBox
+	if _, err := fmt.Sscanf(s, "%g,%g,%g,%g", &b.MinLon, &b.MinLat, &b.MaxLon, &b.MaxLat); err != nil {
+		return nil, fmt.Errorf("bbox must be minLon,minLat,maxLon,maxLat")
+	}
+	if math.Abs(b.MinLat) > 90 || math.Abs(b.MaxLat) > 90 || math.Abs(b.MinLon) > 180 || math.Abs(b.MaxLon) > 180 || b.MinLat > b.MaxLat {
+		return nil, fmt.Errorf("bbox is out of range")
+	}
+	return &b, nil
+}
+
+func (b *BBox) contains(lat, lon float64) bool {
+	if lat < b.MinLat || lat > b.MaxLat {
+		return false
+	}
+	if b.MinLon <= b.MaxLon {
+		return lon >= b.MinLon && lon <= b.MaxLon
+	}
+	return lon >= b.MinLon || lon <= b.MaxLon
+}
+
+type MapCluster struct {
+	Geohash   string  `json:"geohash"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Count     int     `json:"count"`
+	PhotoID   int64   `json:"photo_id"`
+}
+
+type photoMetadata struct {
+	CapturedAt  *time.Time
+	Latitude    *float64
+	Longitude   *float64
+	Altitude    *float64
+	CameraMake  string
+	CameraModel string
+}
+
+// readPhotoMetadata reads capture time, GPS position and camera from a
+// photo's EXIF with exiftool, which understands every supported RAW format.
+func readPhotoMetadata(path string) (*photoMetadata, error) {
+	cmd := exec.Command("exiftool", "-n", "-json",
+		"-DateTimeOriginal",
+		"-Composite:GPSLatitude",
+		"-Composite:GPSLongitude",
+		"-Composite:GPSAltitude",
+		"-Make",
+		"-Model",
+		path,
+	)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("exiftool failed: %w", err)
+	}
+
+	var results []struct {
+		DateTimeOriginal string   `json:"DateTimeOriginal"`
+		GPSLatitude      *float64 `json:"GPSLatitude"`
+		GPSLongitude     *float64 `json:"GPSLongitude"`
+		GPSAltitude      *float64 `json:"GPSAltitude"`
+		Make             any      `json:"Make"`
+		Model            any      `json:"Model"`
+	}
+	if err := json.Unmarshal(output, &results); err != nil || len(results) == 0 {
+		return nil, fmt.Errorf("exiftool parse failed: %v", err)
+	}
+	r := results[0]
+
+	meta := &photoMetadata{
+		CameraMake:  strings.TrimSpace(fmt.Sprint(valueOrEmpty(r.Make))),
+		CameraModel: strings.TrimSpace(fmt.Sprint(valueOrEmpty(r.Model))),
+	}
+	if t, err := time.Parse("2006:01:02 15:04:05", r.DateTimeOriginal); err == nil {
+		meta.CapturedAt = &t
+	}
+	// Cameras without a fix often write 0,0
+	if r.GPSLatitude != nil && r.GPSLongitude != nil && (*r.GPSLatitude != 0 || *r.GPSLongitude != 0) {
+		meta.Latitude, meta.Longitude, meta.Altitude = r.GPSLatitude, r.GPSLongitude, r.GPSAltitude
+	}
+	return meta, nil
+}
+
+// valueOrEmpty keeps numeric-looking model names such as "5D" intact while
+// mapping absent tags to an empty string.
+func valueOrEmpty(v any) any {
+	if v == nil {
+		return ""
+	}
+	return v
+}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestEncodeGeohash(t *testing.T) {
+	tests := []struct {
+		lat, lon  float64
+		precision int
+		want      string
+	}{
+		{57.64911, 10.40744, 11, "u4pruydqqvj"},
+		{42.6, -5.6, 5, "ezs42"},
+		{0, 0, 4, "s000"},
+		{-90, -180, 3, "000"},
+		{90, 180, 3, "zzz"},
+	}
+	for _, tt := range tests {
+		if got := encodeGeohash(tt.lat, tt.lon, tt.precision); got != tt.want {
+			t.Errorf("encodeGeohash(%g, %g, %d) = %q, want %q", tt.lat, tt.lon, tt.precision, got, tt.want)
+		}
+	}
+}
+
+func TestParseBBox(t *testing.T) {
+	tests := []struct {
+		in   string
+		want *BBox
+	}{
+		{"10.5,59.8,10.9,60", &BBox{10.5, 59.8, 10.9, 60}},
+		{"-180,-90,180,90", &BBox{-180, -90, 180, 90}},
+		{"170,-10,-170,10", &BBox{170, -10, -170, 10}},
+		{"", nil},
+		{"1,2,3", nil},
+		{"a,b,c,d", nil},
+		{"0,0,181,10", nil},
+		{"0,-91,10,10", nil},
+		{"0,20,10,10", nil},
+	}
+	for _, tt := range tests {
+		got, err := ParseBBox(tt.in)
+		switch {
+		case tt.want == nil && err == nil:
+			t.Errorf("ParseBBox(%q) = %+v, want error", tt.in, got)
+		case tt.want != nil && err != nil:
+			t.Errorf("ParseBBox(%q): %v", tt.in, err)
+		case tt.want != nil && *got != *tt.want:
+			t.Errorf("ParseBBox(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestBBoxContains(t *testing.T) {
+	tests := []struct {
+		name     string
+		box      BBox
+		lat, lon float64
+		want     bool
+	}{
+		{"inside", BBox{10, 59, 11, 60}, 59.9, 10.7, true},
+		{"edge", BBox{10, 59, 11, 60}, 60, 11, true},
+		{"north", BBox{10, 59, 11, 60}, 60.1, 10.7, false},
+		{"east", BBox{10, 59, 11, 60}, 59.9, 11.1, false},
+		{"antimeridian east", BBox{170, -10, -170, 10}, 0, 175, true},
+		{"antimeridian west", BBox{170, -10, -170, 10}, 0, -175, true},
+		{"antimeridian outside", BBox{170, -10, -170, 10}, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.box.contains(tt.lat, tt.lon); got != tt.want {
+				t.Errorf("contains(%g, %g) = %v, want %v", tt.lat, tt.lon, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Place is the named location of a photo, resolved offline from the
+// gazetteer.
+type Place struct {
+	Country string
+	Region  string
+	City    string
+}
+
+type gazetteerCity struct {
+	name     string
+	lat, lon float64
+	country  string
+	admin1   string
+}
+
+// Geocoder resolves coordinates to the nearest populated place in a GeoNames
+// cities dump (cities500.txt, cities1000.txt, ...). admin1CodesASCII.txt and
+// countryInfo.txt from the same download are picked up from the dump's
+// directory for region and country names; without them the codes are used.
+type Geocoder struct {
+	cities    []gazetteerCity
+	grid      map[[2]int][]int
+	regions   map[string]string
+	countries map[string]string
+	maxKm     float64
+}
+
+// NewGeocoder loads the gazetteer at path. An empty path disables reverse
+// geocoding and returns nil.
+func NewGeocoder(path string, maxKm float64) (*Geocoder, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	g := &Geocoder{
+		grid:      make(map[[2]int][]int),
+		regions:   make(map[string]string),
+		countries: make(map[string]string),
+		maxKm:     maxKm,
+	}
+
+	err := readTSV(path, func(fields []string) {
+		if len(fields) < 11 {
+			return
+		}
+		lat, err1 := strconv.ParseFloat(fields[4], 64)
+		lon, err2 := strconv.ParseFloat(fields[5], 64)
+		if err1 != nil || err2 != nil {
+			return
+		}
+		g.grid[gridCell(lat, lon)] = append(g.grid[gridCell(lat, lon)], len(g.cities))
+		g.cities = append(g.cities, gazetteerCity{
+			name:    fields[1],
+			lat:     lat,
+			lon:     lon,
+			country: fields[8],
+			admin1:  fields[10],
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gazetteer: %w", err)
+	}
+	if len(g.cities) == 0 {
+		return nil, fmt.Errorf("gazetteer %s contains no places", path)
+	}
+
+	// Name tables are optional
+	dir := filepath.Dir(path)
+	readTSV(filepath.Join(dir, "admin1CodesASCII.txt"), func(fields []string) {
+		if len(fields) >= 2 {
+			g.regions[fields[0]] = fields[1]
+		}
+	})
+	readTSV(filepath.Join(dir, "countryInfo.txt"), func(fields []string) {
+		if len(fields) >= 5 {
+			g.countries[fields[0]] = fields[4]
+		}
+	})
+
+	return g, nil
+}
+
+// readTSV calls fn for each line of a tab separated GeoNames file, skipping
+// comments.
+func readTSV(path string, fn func(fields []string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fn(strings.Split(line, "\t"))
+	}
+	return scanner.Err()
+}
+
+func gridCell(lat, lon float64) [2]int {
+	return [2]int{int(math.Floor(lat)), int(math.Floor(lon))}
+}
+
+// Lookup returns the place nearest to the coordinates, or false when
+// nothing lies within the configured distance.
+func (g *Geocoder) Lookup(lat, lon float64) (Place, bool) {
+	best, bestKm := -1, math.Inf(1)
+
+	// Search one degree cells in growing rings. A match in ring r may still
+	// be beaten by one in ring r+1, so stop one ring after the first hit.
+	maxRing := int(math.Ceil(g.maxKm/111)) + 1
+	for ring := 0; ring <= maxRing; ring++ {
+		center := gridCell(lat, lon)
+		for dy := -ring; dy <= ring; dy++ {
+			for dx := -ring; dx <= ring; dx++ {
+				if max(abs(dx), abs(dy)) != ring {
+					continue
+				}
+				cell := [2]int{center[0] + dy, wrapLon(center[1] + dx)}
+				for _, i := range g.grid[cell] {
+					c := &g.cities[i]
+					if km := haversineKm(lat, lon, c.lat, c.lon); km < bestKm {
+						best, bestKm = i, km
+					}
+				}
+			}
+		}
+		if best >= 0 && ring > 0 && bestKm <= float64(ring)*111*math.Cos(lat*math.Pi/180) {
+			break
+		}
+	}
+
+	if best < 0 || bestKm > g.maxKm {
+		return Place{}, false
+	}
+	c := &g.cities[best]
+	place := Place{Country: c.country, Region: c.admin1, City: c.name}
+	if name, ok := g.countries[c.country]; ok {
+		place.Country = name
+	}
+	if name, ok := g.regions[c.country+"."+c.admin1]; ok {
+		place.Region = name
+	}
+	return place, true
+}
+
+// Annotate sets the place fields of p from its coordinates. Items without
+// a position or a nearby place are cleared.
+func (g *Geocoder) Annotate(p *Photo) {
+	p.Country, p.Region, p.City = "", "", ""
+	if g == nil || p.Latitude == nil || p.Longitude == nil {
+		return
+	}
+	if place, ok := g.Lookup(*p.Latitude, *p.Longitude); ok {
+		p.Country, p.Region, p.City = place.Country, place.Region, place.City
+	}
+}
+
+func wrapLon(cell int) int {
+	return ((cell+180)%360+360)%360 - 180
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadiusKm = 6371
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
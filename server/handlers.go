@@ -1,48 +1,135 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Handler struct {
 	cfg     *Config
 	db      *Database
 	scanner *Scanner
+	images  *ImageCache
+	thumbs  *ThumbnailCache
+	hls     *Transcoder
+	uploads *Uploader
+	imports *Importer
 }
 
-func NewHandler(cfg *Config, db *Database, scanner *Scanner) *Handler {
-	return &Handler{cfg: cfg, db: db, scanner: scanner}
+func NewHandler(cfg *Config, db *Database, scanner *Scanner, images *ImageCache, thumbs *ThumbnailCache, hls *Transcoder, uploads *Uploader, imports *Importer) *Handler {
+	return &Handler{cfg: cfg, db: db, scanner: scanner, images: images, thumbs: thumbs, hls: hls, uploads: uploads, imports: imports}
+}
+
+// photoFilter reads the listing filters shared by photo listings and
+// place facets.
+func photoFilter(r *http.Request) PhotoFilter {
+	q := r.URL.Query()
+	return PhotoFilter{
+		Folder:    q.Get("folder"),
+		MediaType: q.Get("media_type"),
+		Country:   q.Get("country"),
+		Region:    q.Get("region"),
+		City:      q.Get("city"),
+		Place:     q.Get("place"),
+	}
 }
 
 func (h *Handler) ListPhotos(w http.ResponseWriter, r *http.Request) {
-	folder := r.URL.Query().Get("folder")
-	mediaType := r.URL.Query().Get("media_type")
+	filter := photoFilter(r)
+	if filter.hasPlace() && redactsLocation(r) {
+		http.Error(w, "Location access denied", http.StatusForbidden)
+		return
+	}
 
-	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	limit, offset := pageParams(r)
+	photos, err := h.db.ListPhotos(filter, limit, offset)
+	if err != nil {
+		log.Printf("Error listing photos: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.applyPrivacy(r, photos...)
+	h.jsonResponse(w, photos)
+
+	if len(photos) == limit {
+		go h.prefetchThumbnails(filter, limit, offset+limit)
+	}
+}
+
+func pageParams(r *http.Request) (limit, offset int) {
+	limit, _ = strconv.Atoi(r.URL.Query().Get("limit"))
 	if limit <= 0 || limit > 1000 {
 		limit = 100
 	}
 
-	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	offset, _ = strconv.Atoi(r.URL.Query().Get("offset"))
 	if offset < 0 {
 		offset = 0
 	}
+	return limit, offset
+}
+
+// prefetchThumbnails loads the next listing page into the thumbnail cache
+// in the variant clients last requested. Only one prefetch runs at a time.
+func (h *Handler) prefetchThumbnails(filter PhotoFilter, limit, offset int) {
+	if !h.thumbs.prefetching.CompareAndSwap(false, true) {
+		return
+	}
+	defer h.thumbs.prefetching.Store(false)
+
+	variant, ok := h.thumbs.LastVariant()
+	if !ok {
+		variant = thumbnailVariant{h.cfg.DefaultRendition, h.cfg.PrimaryFormat()}
+	}
+	rendition, ok := h.cfg.Rendition(variant.Rendition)
+	if !ok {
+		return
+	}
 
-	photos, err := h.db.ListPhotos(folder, mediaType, limit, offset)
+	photos, err := h.db.ListPhotos(filter, limit, offset)
 	if err != nil {
-		log.Printf("Error listing photos: %v", err)
+		log.Printf("Error listing photos for prefetch: %v", err)
+		return
+	}
+	for _, p := range photos {
+		if !h.thumbs.Contains(p.ID, rendition.Name, variant.Format) {
+			h.loadThumbnail(p, rendition, variant.Format)
+		}
+	}
+}
+
+// GetPlaces counts matching items per country, region and city, taking the
+// same filters as ListPhotos.
+func (h *Handler) GetPlaces(w http.ResponseWriter, r *http.Request) {
+	if redactsLocation(r) {
+		http.Error(w, "Location access denied", http.StatusForbidden)
+		return
+	}
+
+	facets, err := h.db.PlaceFacets(photoFilter(r))
+	if err != nil {
+		log.Printf("Error counting places: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	h.jsonResponse(w, photos)
+	h.jsonResponse(w, facets)
 }
 
 func (h *Handler) GetPhoto(w http.ResponseWriter, r *http.Request) {
@@ -59,6 +146,7 @@ func (h *Handler) GetPhoto(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.applyPrivacy(r, photo)
 	h.jsonResponse(w, photo)
 }
 
@@ -70,14 +158,210 @@ func (h *Handler) GetThumbnail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	rendition, ok := h.cfg.Rendition(r.URL.Query().Get("size"))
+	if !ok {
+		http.Error(w, "Unknown thumbnail size", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Vary", "Accept")
+	format := negotiateImageFormat(r.Header.Get("Accept"), h.cfg.ThumbnailFormats)
+
+	thumb, ok := h.thumbs.Get(id, rendition.Name, format)
+	if !ok {
+		photo, err := h.db.GetPhotoByID(id)
+		if err != nil {
+			http.Error(w, "Photo not found", http.StatusNotFound)
+			return
+		}
+		if thumb, err = h.loadThumbnail(photo, rendition, format); err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	h.serveContent(w, r, thumb.ETag, imageContentType(thumb.Format), thumb.ModTime, bytes.NewReader(thumb.Data))
+}
+
+// loadThumbnail reads a rendition from disk and adds it to the thumbnail
+// cache.
+func (h *Handler) loadThumbnail(photo *Photo, rendition Rendition, format string) (*CachedThumbnail, error) {
+	thumbPath, servedFormat := h.thumbnailFile(photo, rendition, format)
+	// Stat first, so a file replaced while it is read looks changed later
+	stat, err := os.Stat(thumbPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(thumbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	thumb := &CachedThumbnail{
+		PhotoID:      photo.ID,
+		OriginalPath: photo.OriginalPath,
+		Path:         thumbPath,
+		Format:       servedFormat,
+		ETag:         fileETag(photo, "thumbnail:"+rendition.Name+":"+servedFormat, stat),
+		ModTime:      stat.ModTime(),
+		Size:         stat.Size(),
+		Data:         data,
+	}
+	h.thumbs.Add(rendition.Name, format, thumb)
+	return thumb, nil
+}
+
+// thumbnailFile resolves the file for a rendition in the given format,
+// falling back to the stored thumbnail until the next scan generates it.
+func (h *Handler) thumbnailFile(photo *Photo, rendition Rendition, format string) (string, string) {
+	thumbPath, err := h.cfg.RenditionPath(photo.OriginalPath, rendition.Name, format)
+	if err == nil {
+		if _, err := os.Stat(thumbPath); err == nil {
+			return thumbPath, format
+		}
+	}
+	return photo.ThumbnailPath, formatFromPath(photo.ThumbnailPath)
+}
+
+const maxBatchThumbnails = 500
+
+// BatchThumbnails streams the requested thumbnails as one multipart/mixed
+// response, in request order. Each part carries X-Photo-ID and X-Status so
+// missing items can be told apart without failing the whole batch.
+func (h *Handler) BatchThumbnails(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs    []int64 `json:"ids"`
+		Size   string  `json:"size"`
+		Format string  `json:"format"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) == 0 || len(req.IDs) > maxBatchThumbnails {
+		http.Error(w, fmt.Sprintf("ids must contain between 1 and %d entries", maxBatchThumbnails), http.StatusBadRequest)
+		return
+	}
+
+	rendition, ok := h.cfg.Rendition(req.Size)
+	if !ok {
+		http.Error(w, "Unknown thumbnail size", http.StatusBadRequest)
+		return
+	}
+
+	format := req.Format
+	if format == "" {
+		format = h.cfg.PrimaryFormat()
+	} else if !slices.Contains(h.cfg.ThumbnailFormats, format) {
+		http.Error(w, "Unsupported thumbnail format", http.StatusBadRequest)
+		return
+	}
+
+	photos, err := h.db.GetPhotosByIDs(req.IDs)
+	if err != nil {
+		log.Printf("Error fetching photos for batch: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusOK)
+
+	for _, id := range req.IDs {
+		if err := h.writeBatchPart(mw, id, photos[id], rendition, format); err != nil {
+			// The client has gone away; nothing more can be sent
+			log.Printf("Error writing batch thumbnail %d: %v", id, err)
+			return
+		}
+	}
+	mw.Close()
+}
+
+func (h *Handler) writeBatchPart(mw *multipart.Writer, id int64, photo *Photo, rendition Rendition, format string) error {
+	header := textproto.MIMEHeader{}
+	header.Set("X-Photo-ID", strconv.FormatInt(id, 10))
+
+	var data []byte
+	status := http.StatusOK
+	thumb, ok := h.thumbs.Get(id, rendition.Name, format)
+	if !ok && photo != nil {
+		thumb, _ = h.loadThumbnail(photo, rendition, format)
+	}
+	if thumb == nil {
+		status = http.StatusNotFound
+	} else {
+		data = thumb.Data
+		header.Set("Content-Type", imageContentType(thumb.Format))
+		header.Set("ETag", thumb.ETag)
+	}
+	header.Set("X-Status", strconv.Itoa(status))
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(data)
+	return err
+}
+
+func (h *Handler) GetImage(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	// Renders come from the largest rendition, so never exceed it
+	largest := h.cfg.RenditionsBySize()[0]
+	req, err := ParseImageRequest(r.URL.Query().Get, largest.Size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	photo, err := h.db.GetPhotoByID(id)
 	if err != nil {
 		http.Error(w, "Photo not found", http.StatusNotFound)
 		return
 	}
 
-	// Serve the thumbnail file
-	h.serveFile(w, r, photo.ThumbnailPath, "image/jpeg")
+	if req.Format == "" {
+		w.Header().Set("Vary", "Accept")
+		req.Format = negotiateImageFormat(r.Header.Get("Accept"), h.cfg.ThumbnailFormats)
+	}
+	req.Metadata = h.cfg.RenditionMetadata
+	if req.Quality == 0 {
+		req.Quality = h.cfg.ThumbnailQuality
+	}
+
+	src, err := h.cfg.RenditionPath(photo.OriginalPath, largest.Name, h.cfg.PrimaryFormat())
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		src = photo.ThumbnailPath
+		if srcInfo, err = os.Stat(src); err != nil {
+			http.Error(w, "Thumbnail not found", http.StatusNotFound)
+			return
+		}
+	}
+	key := req.cacheKey(photo, srcInfo.ModTime())
+
+	path, err := h.images.Get(key, func(dst string) error {
+		return renderImage(src, dst, req)
+	})
+	if err != nil {
+		log.Printf("Error rendering image for %d: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.serveFile(w, r, photo, "image:"+key, path, imageContentType(req.Format))
 }
 
 func (h *Handler) GetOriginal(w http.ResponseWriter, r *http.Request) {
@@ -94,14 +378,13 @@ func (h *Handler) GetOriginal(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	contentType := "application/octet-stream"
 	if photo.MediaType == "video" {
-		w.Header().Set("Content-Disposition", "attachment; filename=\""+photo.Filename+"\"")
-		h.serveFileWithRanges(w, r, photo.OriginalPath, photo.Filename)
-		return
+		contentType = videoContentType(photo.Extension)
 	}
 
 	w.Header().Set("Content-Disposition", "attachment; filename=\""+photo.Filename+"\"")
-	h.serveFile(w, r, photo.OriginalPath, "application/octet-stream")
+	h.serveFile(w, r, photo, "original", photo.OriginalPath, contentType)
 }
 
 func (h *Handler) StreamVideo(w http.ResponseWriter, r *http.Request) {
@@ -123,7 +406,209 @@ func (h *Handler) StreamVideo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.serveFileWithRanges(w, r, photo.OriginalPath, photo.Filename)
+	h.serveFile(w, r, photo, "original", photo.OriginalPath, videoContentType(photo.Extension))
+}
+
+// video looks up the video named by the id path value, writing an error
+// response on failure.
+func (h *Handler) video(w http.ResponseWriter, r *http.Request) (*Photo, bool) {
+	idStr := r.PathValue("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	photo, err := h.db.GetPhotoByID(id)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	if photo.MediaType != "video" {
+		http.Error(w, "Not a video", http.StatusBadRequest)
+		return nil, false
+	}
+	return photo, true
+}
+
+// GetPlayback tells clients whether to play a video directly or through
+// HLS. max_kbps lets clients on slow links force HLS for high bitrate
+// sources.
+func (h *Handler) GetPlayback(w http.ResponseWriter, r *http.Request) {
+	photo, ok := h.video(w, r)
+	if !ok {
+		return
+	}
+
+	maxKbps := h.cfg.DirectPlayMaxKbps
+	if v, err := strconv.Atoi(r.URL.Query().Get("max_kbps")); err == nil && v > 0 {
+		maxKbps = v
+	}
+
+	resp := map[string]string{
+		"mode": "hls",
+		"url":  fmt.Sprintf("/api/photos/%d/hls/master.m3u8", photo.ID),
+	}
+	if DirectPlayable(photo, maxKbps) {
+		resp["mode"] = "direct"
+		resp["url"] = fmt.Sprintf("/api/photos/%d/stream", photo.ID)
+	}
+	h.jsonResponse(w, resp)
+}
+
+func (h *Handler) GetHLSMaster(w http.ResponseWriter, r *http.Request) {
+	photo, ok := h.video(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, h.cfg.MasterPlaylist(photo))
+}
+
+// GetHLSFile serves a rendition playlist or segment, transcoding the
+// rendition on first request.
+func (h *Handler) GetHLSFile(w http.ResponseWriter, r *http.Request) {
+	photo, ok := h.video(w, r)
+	if !ok {
+		return
+	}
+
+	rendition, ok := h.cfg.HLSRendition(photo, r.PathValue("rendition"))
+	if !ok {
+		http.Error(w, "Unknown rendition", http.StatusNotFound)
+		return
+	}
+
+	name := r.PathValue("file")
+	contentType := "video/mp2t"
+	if name == "index.m3u8" {
+		contentType = "application/vnd.apple.mpegurl"
+	} else if !hlsSegmentPattern.MatchString(name) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	path, err := h.hls.File(photo, rendition, name)
+	if errors.Is(err, ErrTranscodeBusy) {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Transcoder busy", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("Error serving HLS %s/%s for %d: %v", rendition.Name, name, photo.ID, err)
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	h.serveFile(w, r, photo, "hls:"+rendition.Name+"/"+name, path, contentType)
+}
+
+// videoAsset looks up the video named by the id path value and the path of
+// one of its generated assets, writing an error response on failure.
+func (h *Handler) videoAsset(w http.ResponseWriter, r *http.Request, kind string) (*Photo, string, bool) {
+	idStr := r.PathValue("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	photo, err := h.db.GetPhotoByID(id)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return nil, "", false
+	}
+
+	if photo.MediaType != "video" {
+		http.Error(w, "Not a video", http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	path, err := h.cfg.VideoAssetPath(photo.OriginalPath, kind)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, "", false
+	}
+	return photo, path, true
+}
+
+func (h *Handler) GetVideoPreview(w http.ResponseWriter, r *http.Request) {
+	photo, path, ok := h.videoAsset(w, r, "preview")
+	if !ok {
+		return
+	}
+	h.serveFile(w, r, photo, "preview", path, "video/mp4")
+}
+
+func (h *Handler) GetScrubStrip(w http.ResponseWriter, r *http.Request) {
+	photo, path, ok := h.videoAsset(w, r, "scrub")
+	if !ok {
+		return
+	}
+	h.serveFile(w, r, photo, "scrub", path, "image/jpeg")
+}
+
+func (h *Handler) GetScrubIndex(w http.ResponseWriter, r *http.Request) {
+	photo, path, ok := h.videoAsset(w, r, "scrub-index")
+	if !ok {
+		return
+	}
+	h.serveFile(w, r, photo, "scrub-index", path, "application/json")
+}
+
+// SetPoster overrides the poster frame of a video with {"time": seconds},
+// or restores automatic selection with {"time": null}, and regenerates its
+// thumbnails before responding with the updated item.
+func (h *Handler) SetPoster(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Time *float64 `json:"time"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	photo, err := h.db.GetPhotoByID(id)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if photo.MediaType != "video" {
+		http.Error(w, "Not a video", http.StatusBadRequest)
+		return
+	}
+	if req.Time != nil && (*req.Time < 0 || (photo.Duration > 0 && *req.Time >= photo.Duration)) {
+		http.Error(w, "Time is outside the video", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.scanner.SetPoster(photo, req.Time); err != nil {
+		if errors.Is(err, errScanRunning) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("Error regenerating poster for %s: %v", photo.OriginalPath, err)
+		http.Error(w, "Failed to regenerate poster", http.StatusInternalServerError)
+		return
+	}
+
+	photo, err = h.db.GetPhotoByID(id)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	h.applyPrivacy(r, photo)
+	h.jsonResponse(w, photo)
 }
 
 func (h *Handler) ListFolders(w http.ResponseWriter, r *http.Request) {
@@ -137,6 +622,516 @@ func (h *Handler) ListFolders(w http.ResponseWriter, r *http.Request) {
 	h.jsonResponse(w, folders)
 }
 
+// spriteIndex loads the listing page named by the path and page query
+// parameters and lays it out as a sprite sheet.
+func (h *Handler) spriteIndex(r *http.Request) (*SpriteIndex, error) {
+	folder := r.URL.Query().Get("path")
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 0 {
+		page = 0
+	}
+
+	pageSize := h.cfg.SpritePageSize
+	photos, err := h.db.ListPhotos(PhotoFilter{Folder: folder}, pageSize+1, page*pageSize)
+	if err != nil {
+		return nil, err
+	}
+	hasMore := len(photos) > pageSize
+	if hasMore {
+		photos = photos[:pageSize]
+	}
+
+	return h.cfg.BuildSpriteIndex(folder, page, photos, hasMore), nil
+}
+
+func (h *Handler) GetFolderSpriteIndex(w http.ResponseWriter, r *http.Request) {
+	idx, err := h.spriteIndex(r)
+	if err != nil {
+		log.Printf("Error building sprite index: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.jsonResponse(w, idx)
+}
+
+func (h *Handler) GetFolderSprite(w http.ResponseWriter, r *http.Request) {
+	idx, err := h.spriteIndex(r)
+	if err != nil {
+		log.Printf("Error building sprite index: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(idx.Tiles) == 0 {
+		http.Error(w, "Sprite page is empty", http.StatusNotFound)
+		return
+	}
+
+	path, err := h.images.Get(idx.cacheKey(), func(dst string) error {
+		return renderSprite(idx, dst, h.cfg.ThumbnailQuality)
+	})
+	if err != nil {
+		log.Printf("Error rendering sprite for %q page %d: %v", idx.Folder, idx.Page, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "public, no-cache")
+	w.Header().Set("ETag", `"`+idx.Version+`"`)
+	http.ServeFile(w, r, path)
+}
+
+// GetMap returns geotagged photos and videos inside a viewport, clustered
+// by geohash cell sized for the zoom level.
+func (h *Handler) GetMap(w http.ResponseWriter, r *http.Request) {
+	if redactsLocation(r) {
+		http.Error(w, "Location access denied", http.StatusForbidden)
+		return
+	}
+
+	bbox, err := ParseBBox(r.URL.Query().Get("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	zoom := 0
+	if z := r.URL.Query().Get("zoom"); z != "" {
+		if zoom, err = strconv.Atoi(z); err != nil || zoom < 0 || zoom > 22 {
+			http.Error(w, "Invalid zoom", http.StatusBadRequest)
+			return
+		}
+	}
+
+	precision := clusterPrecision(zoom)
+	clusters, err := h.mapClusters(bbox, precision)
+	if err != nil {
+		log.Printf("Error clustering map markers: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if clusters == nil {
+		clusters = []*MapCluster{}
+	}
+
+	h.jsonResponse(w, map[string]any{
+		"zoom":      zoom,
+		"precision": precision,
+		"clusters":  clusters,
+	})
+}
+
+// DeletePhoto moves an item to the trash. Its original is moved to the
+// trash directory until it is restored or purged.
+func (h *Handler) DeletePhoto(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	photo, err := h.db.GetPhotoByID(id)
+	if err != nil {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	if err := h.scanner.Trash(photo); err != nil {
+		fileError(w, "trashing "+photo.OriginalPath, err)
+		return
+	}
+
+	h.applyPrivacy(r, photo)
+	h.jsonResponse(w, photo)
+}
+
+// ListTrash lists deleted items, most recently deleted first.
+func (h *Handler) ListTrash(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pageParams(r)
+	photos, err := h.db.ListPhotos(PhotoFilter{Trash: true}, limit, offset)
+	if err != nil {
+		log.Printf("Error listing trash: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.applyPrivacy(r, photos...)
+	h.jsonResponse(w, photos)
+}
+
+func (h *Handler) RestorePhoto(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	photo, err := h.db.GetPhotoByID(id)
+	if err != nil {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	if err := h.scanner.Restore(photo); err != nil {
+		fileError(w, "restoring "+photo.OriginalPath, err)
+		return
+	}
+
+	h.applyPrivacy(r, photo)
+	h.jsonResponse(w, photo)
+}
+
+// MovePhoto renames an item and moves it to another folder. Either field
+// may be left out to keep the current value; "" is the top level folder.
+func (h *Handler) MovePhoto(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Folder *string `json:"folder"`
+		Name   string  `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	photo, err := h.db.GetPhotoByID(id)
+	if err != nil || photo.DeletedAt != nil {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	folder := photo.Folder
+	if req.Folder != nil {
+		folder = *req.Folder
+	}
+	if err := h.scanner.MovePhoto(photo, folder, req.Name); err != nil {
+		fileError(w, "moving "+photo.OriginalPath, err)
+		return
+	}
+
+	photo, err = h.db.GetPhotoByID(id)
+	if err != nil {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	h.applyPrivacy(r, photo)
+	h.jsonResponse(w, photo)
+}
+
+// MoveFolder moves or renames a folder with everything in it.
+func (h *Handler) MoveFolder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := h.scanner.MoveFolder(req.From, req.To); err != nil {
+		fileError(w, "moving folder "+req.From, err)
+		return
+	}
+	h.jsonResponse(w, map[string]string{"path": strings.Trim(req.To, "/")})
+}
+
+func (h *Handler) CreateFolder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := h.scanner.CreateFolder(req.Path); err != nil {
+		fileError(w, "creating folder "+req.Path, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"path": strings.Trim(req.Path, "/")})
+}
+
+// fileError answers a failed file operation. Problems with the request
+// are reported to the client; anything else is logged.
+func fileError(w http.ResponseWriter, action string, err error) {
+	switch {
+	case errors.Is(err, errPathEscapes), errors.Is(err, errInvalidName), errors.Is(err, errExtension),
+		errors.Is(err, errMoveIntoSelf), errors.Is(err, errOriginalsRoot):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errNotFolder):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errPathExists), errors.Is(err, errScanRunning), errors.Is(err, errCrossFilesys),
+		errors.Is(err, errNotTrashed), errors.Is(err, errOriginalExists), errors.Is(err, errOriginalMissing):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Error %s: %v", action, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// Download streams the originals of a selection (`ids`) or of a folder and
+// its subfolders as one ZIP, with unindexed sidecars if asked for.
+func (h *Handler) Download(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs      []int64 `json:"ids"`
+		Folder   string  `json:"folder"`
+		Sidecars bool    `json:"sidecars"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if (len(req.IDs) == 0) == (req.Folder == "") {
+		http.Error(w, "Give either ids or a folder", http.StatusBadRequest)
+		return
+	}
+
+	plan := newArchivePlan(h.cfg.OriginalsPath)
+	filename := "photos.zip"
+	if req.Folder != "" {
+		dir, err := h.scanner.resolveOriginal(req.Folder)
+		if err != nil || dir == h.cfg.OriginalsPath {
+			http.Error(w, "Invalid folder", http.StatusBadRequest)
+			return
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+			return
+		}
+		rel, _ := filepath.Rel(h.cfg.OriginalsPath, dir)
+		photos, err := h.db.ListPhotos(PhotoFilter{Folder: filepath.ToSlash(rel)}, -1, 0)
+		if err != nil {
+			log.Printf("Error listing folder for download: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		slices.SortFunc(photos, func(a, b *Photo) int { return strings.Compare(a.OriginalPath, b.OriginalPath) })
+		for _, p := range photos {
+			// The folder filter uses LIKE, so check the match is really below dir
+			name, err := filepath.Rel(dir, p.OriginalPath)
+			if err != nil || !filepath.IsLocal(name) {
+				continue
+			}
+			plan.addPhoto(h.db, p, filepath.ToSlash(name), req.Sidecars)
+		}
+		filename = filepath.Base(dir) + ".zip"
+	} else {
+		for _, id := range req.IDs {
+			p, err := h.db.GetPhotoByID(id)
+			if err != nil || p.DeletedAt != nil {
+				http.Error(w, fmt.Sprintf("Photo %d not found", id), http.StatusNotFound)
+				return
+			}
+			plan.addPhoto(h.db, p, p.Filename, req.Sidecars)
+		}
+	}
+	if len(plan.items) == 0 {
+		http.Error(w, "Nothing to download", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	// Folder names may hold quotes or non-ASCII, which need escaping or RFC 2231 encoding
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	manifest := &ArchiveManifest{Created: time.Now(), Folder: req.Folder}
+	if err := plan.writeArchive(w, manifest); err != nil {
+		// Headers are out, so the client sees a truncated archive
+		log.Printf("Error streaming download: %v", err)
+	}
+}
+
+// UploadOptions advertises the supported tus version and extensions.
+func (h *Handler) UploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Checksum-Algorithm", tusChecksums)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.cfg.UploadMaxBytes, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateUpload starts a resumable upload. Upload-Metadata must carry the
+// filename and may carry a hex sha256 of the whole file.
+func (h *Handler) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusRequest(w, r) {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "Upload-Length is required", http.StatusBadRequest)
+		return
+	}
+	if length > h.cfg.UploadMaxBytes {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.cfg.UploadMaxBytes, 10))
+		http.Error(w, "Upload exceeds upload_max_bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	up, err := h.uploads.Create(meta["filename"], length, meta["sha256"])
+	switch {
+	case errors.Is(err, errInvalidName):
+		http.Error(w, "Upload-Metadata needs a valid filename", http.StatusBadRequest)
+		return
+	case errors.Is(err, errUnsupportedFile):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	case err != nil:
+		log.Printf("Error creating upload: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/api/upload/"+up.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// GetUploadOffset tells a client where to resume.
+func (h *Handler) GetUploadOffset(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	up, offset, err := h.uploads.Get(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// PatchUpload appends a chunk. The response to the final chunk carries
+// X-Photo-ID once the file is indexed, and X-Duplicate when the library
+// already had the same content and the upload was dropped.
+func (h *Handler) PatchUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusRequest(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Upload-Offset is required", http.StatusBadRequest)
+		return
+	}
+
+	offset, result, err := h.uploads.Append(r.PathValue("id"), offset, r.Body, r.Header.Get("Upload-Checksum"))
+	switch {
+	case errors.Is(err, errUploadNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errOffsetMismatch), errors.Is(err, errUploadBusy):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errChecksumAlgo), errors.Is(err, errUploadTooLong):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errChecksumMismatch):
+		// Status defined by the tus checksum extension
+		http.Error(w, err.Error(), 460)
+		return
+	case err != nil:
+		log.Printf("Error receiving upload %s: %v", r.PathValue("id"), err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if result != nil && result.Photo != nil {
+		w.Header().Set("X-Photo-ID", strconv.FormatInt(result.Photo.ID, 10))
+	}
+	if result != nil && result.Duplicate {
+		w.Header().Set("X-Duplicate", "true")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusRequest(w, r) {
+		return
+	}
+	switch err := h.uploads.Terminate(r.PathValue("id")); {
+	case errors.Is(err, errUploadNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errUploadBusy):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("Error terminating upload: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusRequest sets the protocol header and rejects clients speaking another
+// version of tus.
+func tusRequest(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// StartImport copies new files from a directory on the server, such as a
+// mounted card, into the originals in the background.
+func (h *Handler) StartImport(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Source string `json:"source"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Source == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	status, err := h.imports.Start(req.Source)
+	switch {
+	case errors.Is(err, errImportSource):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, errImportRunning):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case os.IsNotExist(err):
+		http.Error(w, "Source not found", http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("Error starting import: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(status)
+}
+
+func (h *Handler) GetImport(w http.ResponseWriter, r *http.Request) {
+	h.jsonResponse(w, h.imports.Status())
+}
+
+func (h *Handler) CancelImport(w http.ResponseWriter, r *http.Request) {
+	if err := h.imports.Cancel(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
 func (h *Handler) GetStats(w http.ResponseWriter, r *http.Request) {
 	stats, err := h.db.GetStats()
 	if err != nil {
@@ -144,6 +1139,8 @@ func (h *Handler) GetStats(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	stats.ThumbnailCache = h.thumbs.Stats()
+	stats.CleanupAlert = h.scanner.CleanupAlert()
 
 	h.jsonResponse(w, stats)
 }
@@ -166,7 +1163,10 @@ func (h *Handler) TriggerScan(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "started"})
 }
 
-func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, path, contentType string) {
+// serveFile serves path with a strong ETag and Last-Modified, letting
+// http.ServeContent answer conditional and Range requests. Clients must
+// revalidate on every use, which is a cheap 304 while the file is unchanged.
+func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, photo *Photo, variant, path, contentType string) {
 	file, err := os.Open(path)
 	if err != nil {
 		http.Error(w, "File not found", http.StatusNotFound)
@@ -180,30 +1180,23 @@ func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, path, conten
 		return
 	}
 
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
-	w.Header().Set("Cache-Control", "public, max-age=86400")
-
-	io.Copy(w, file)
+	h.serveContent(w, r, fileETag(photo, variant, stat), contentType, stat.ModTime(), file)
 }
 
-func (h *Handler) serveFileWithRanges(w http.ResponseWriter, r *http.Request, path, filename string) {
-	file, err := os.Open(path)
-	if err != nil {
-		http.Error(w, "File not found", http.StatusNotFound)
-		return
-	}
-	defer file.Close()
-
-	stat, err := file.Stat()
-	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
+func (h *Handler) serveContent(w http.ResponseWriter, r *http.Request, etag, contentType string, modTime time.Time, content io.ReadSeeker) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, no-cache")
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", modTime, content)
+}
 
-	w.Header().Set("Content-Type", videoContentType(filepath.Ext(filename)))
-	w.Header().Set("Cache-Control", "public, max-age=86400")
-	http.ServeContent(w, r, filename, stat.ModTime(), file)
+// fileETag derives a validator from the photo version, the variant being
+// served and the served file, so a regenerated thumbnail gets a new tag even
+// when the original is unchanged.
+func fileETag(photo *Photo, variant string, stat os.FileInfo) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d|%d|%d|%s|%d|%d", photo.ID, photo.ModTime.UnixNano(), photo.FileSize, variant, stat.ModTime().UnixNano(), stat.Size())
+	return fmt.Sprintf(`"%016x"`, h.Sum64())
 }
 
 func videoContentType(ext string) string {
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+)
+
+// fileHash returns the hex SHA-256 of a file's contents.
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// FindDuplicate returns a live item whose original has the given size and
+// SHA-256, or nil. Hashes are only computed for items of the same size, on
+// first use, and stored until the original changes.
+func (s *Scanner) FindDuplicate(size int64, hash string) (*Photo, error) {
+	candidates, err := s.db.PhotosBySize(size)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range candidates {
+		if p.ContentHash == "" {
+			if p.ContentHash, err = fileHash(p.OriginalPath); err != nil {
+				log.Printf("Error hashing %s: %v", p.OriginalPath, err)
+				continue
+			}
+			if err := s.db.SetContentHash(p.ID, p.ContentHash); err != nil {
+				return nil, err
+			}
+		}
+		if p.ContentHash == hash {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HLSRendition is one rung of the adaptive streaming ladder.
+type HLSRendition struct {
+	Name      string `json:"name"`
+	Height    int    `json:"height"`
+	VideoKbps int    `json:"video_kbps"`
+	AudioKbps int    `json:"audio_kbps"`
+}
+
+func DefaultHLSRenditions() []HLSRendition {
+	return []HLSRendition{
+		{Name: "360p", Height: 360, VideoKbps: 800, AudioKbps: 96},
+		{Name: "720p", Height: 720, VideoKbps: 2800, AudioKbps: 128},
+		{Name: "1080p", Height: 1080, VideoKbps: 5000, AudioKbps: 160},
+	}
+}
+
+var hlsSegmentPattern = regexp.MustCompile(`^seg_\d{5}\.ts$`)
+
+const (
+	hlsSegmentSeconds = 6
+	hlsWaitTimeout    = 30 * time.Second
+	hlsCompleteMarker = ".complete"
+)
+
+// DirectPlayable reports whether a video can be played as-is by Safari and
+// AVPlayer within the given bitrate budget, so no transcode is needed.
+func DirectPlayable(p *Photo, maxKbps int) bool {
+	switch p.Extension {
+	case ".mp4", ".m4v", ".mov":
+	default:
+		return false
+	}
+	switch p.VideoCodec {
+	case "h264", "hevc":
+	default:
+		return false
+	}
+	switch p.AudioCodec {
+	case "", "aac", "mp3", "alac":
+	default:
+		return false
+	}
+	if maxKbps > 0 && p.Duration > 0 {
+		kbps := float64(p.FileSize) * 8 / 1000 / p.Duration
+		if kbps > float64(maxKbps) {
+			return false
+		}
+	}
+	return true
+}
+
+// HLSLadder returns the rungs that do not upscale the source. The smallest
+// rung is always included.
+func (c *Config) HLSLadder(p *Photo) []HLSRendition {
+	var ladder []HLSRendition
+	for _, r := range c.HLSRenditions {
+		if p.Height == 0 || r.Height <= p.Height || len(ladder) == 0 {
+			ladder = append(ladder, r)
+		}
+	}
+	return ladder
+}
+
+func (c *Config) HLSRendition(p *Photo, name string) (HLSRendition, bool) {
+	for _, r := range c.HLSLadder(p) {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return HLSRendition{}, false
+}
+
+// hlsWidth scales the source width to height, rounded to an even number as
+// required by H.264.
+func hlsWidth(p *Photo, height int) int {
+	if p.Width == 0 || p.Height == 0 {
+		return int(math.Round(float64(height)*16/9/2)) * 2
+	}
+	return int(math.Round(float64(p.Width)*float64(height)/float64(p.Height)/2)) * 2
+}
+
+// MasterPlaylist lists every rung of the ladder for a video.
+func (c *Config) MasterPlaylist(p *Photo) string {
+	codecs := "avc1.640028"
+	if p.AudioCodec != "" {
+		codecs += ",mp4a.40.2"
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, r := range c.HLSLadder(p) {
+		bandwidth := r.VideoKbps * 1000
+		if p.AudioCodec != "" {
+			bandwidth += r.AudioKbps * 1000
+		}
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"%s\"\n%s/index.m3u8\n",
+			bandwidth, hlsWidth(p, r.Height), r.Height, codecs, r.Name)
+	}
+	return b.String()
+}
+
+type transcodeJob struct {
+	done chan struct{}
+	err  error
+}
+
+// Transcoder produces HLS renditions with ffmpeg on first request and keeps
+// them on disk. Concurrent transcodes are bounded by MaxTranscodes.
+type Transcoder struct {
+	cfg *Config
+	sem chan struct{}
+
+	mu     sync.Mutex
+	active map[string]*transcodeJob
+}
+
+func NewTranscoder(cfg *Config) (*Transcoder, error) {
+	if err := os.MkdirAll(cfg.HLSCachePath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create HLS cache directory: %w", err)
+	}
+	return &Transcoder{
+		cfg:    cfg,
+		sem:    make(chan struct{}, cfg.MaxTranscodes),
+		active: make(map[string]*transcodeJob),
+	}, nil
+}
+
+// ErrTranscodeBusy is returned when every transcode slot is taken.
+var ErrTranscodeBusy = errors.New("too many concurrent transcodes")
+
+// dir is unique per video version, so a modified original is transcoded
+// afresh.
+func (t *Transcoder) dir(p *Photo, rendition string) string {
+	return filepath.Join(t.cfg.HLSCachePath, fmt.Sprintf("%d-%d", p.ID, p.ModTime.Unix()), rendition)
+}
+
+// File returns the path of a playlist or segment of a rendition, starting a
+// transcode if needed and waiting until the file has been written.
+func (t *Transcoder) File(p *Photo, r HLSRendition, name string) (string, error) {
+	dir := t.dir(p, r.Name)
+	path := filepath.Join(dir, name)
+
+	if _, err := os.Stat(filepath.Join(dir, hlsCompleteMarker)); err == nil {
+		if _, err := os.Stat(path); err != nil {
+			return "", err
+		}
+		return path, nil
+	}
+
+	job, err := t.start(p, r, dir)
+	if err != nil {
+		return "", err
+	}
+
+	deadline := time.After(hlsWaitTimeout)
+	for {
+		if ready(path, name) {
+			return path, nil
+		}
+		select {
+		case <-job.done:
+			if job.err != nil {
+				return "", job.err
+			}
+			if _, err := os.Stat(path); err != nil {
+				return "", err
+			}
+			return path, nil
+		case <-deadline:
+			return "", fmt.Errorf("timed out waiting for %s", name)
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// ready reports whether a file written by a running transcode can be
+// served. ffmpeg writes the playlist only after the first segment, and a
+// segment is complete once the playlist references it.
+func ready(path, name string) bool {
+	if name == "index.m3u8" {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	playlist, err := os.ReadFile(filepath.Join(filepath.Dir(path), "index.m3u8"))
+	return err == nil && strings.Contains(string(playlist), name)
+}
+
+func (t *Transcoder) start(p *Photo, r HLSRendition, dir string) (*transcodeJob, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if job, ok := t.active[dir]; ok {
+		return job, nil
+	}
+
+	// Another request may have finished the transcode since File checked
+	if _, err := os.Stat(filepath.Join(dir, hlsCompleteMarker)); err == nil {
+		job := &transcodeJob{done: make(chan struct{})}
+		close(job.done)
+		return job, nil
+	}
+
+	select {
+	case t.sem <- struct{}{}:
+	default:
+		return nil, ErrTranscodeBusy
+	}
+
+	// Discard output left by an interrupted transcode
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		<-t.sem
+		return nil, err
+	}
+
+	job := &transcodeJob{done: make(chan struct{})}
+	t.active[dir] = job
+
+	go func() {
+		job.err = t.transcode(p, r, dir)
+		if job.err != nil {
+			log.Printf("HLS transcode of %s at %s failed: %v", p.OriginalPath, r.Name, job.err)
+		}
+
+		t.mu.Lock()
+		delete(t.active, dir)
+		t.mu.Unlock()
+		<-t.sem
+		close(job.done)
+
+		t.prune()
+	}()
+	return job, nil
+}
+
+func (t *Transcoder) transcode(p *Photo, r HLSRendition, dir string) error {
+	// Keyframes every two seconds so segments can be cut on time
+	gop := "48"
+	if p.Framerate > 0 {
+		gop = strconv.Itoa(int(math.Round(p.Framerate)) * 2)
+	}
+
+	args := []string{
+		"-i", p.OriginalPath,
+		"-vf", fmt.Sprintf("scale=-2:%d", r.Height),
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-profile:v", "high",
+		"-pix_fmt", "yuv420p",
+		"-b:v", fmt.Sprintf("%dk", r.VideoKbps),
+		"-maxrate", fmt.Sprintf("%dk", r.VideoKbps*3/2),
+		"-bufsize", fmt.Sprintf("%dk", r.VideoKbps*2),
+		"-g", gop,
+		"-keyint_min", gop,
+		"-sc_threshold", "0",
+	}
+	args = append(args, t.cfg.ffmpegMetadataArgs()...)
+	if p.AudioCodec != "" {
+		args = append(args, "-c:a", "aac", "-b:a", fmt.Sprintf("%dk", r.AudioKbps), "-ac", "2")
+	} else {
+		args = append(args, "-an")
+	}
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(hlsSegmentSeconds),
+		"-hls_playlist_type", "event",
+		"-hls_segment_filename", filepath.Join(dir, "seg_%05d.ts"),
+		"-y",
+		filepath.Join(dir, "index.m3u8"),
+	)
+
+	if output, err := exec.Command("ffmpeg", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %w: %s", err, lastLines(output, 5))
+	}
+	return os.WriteFile(filepath.Join(dir, hlsCompleteMarker), nil, 0644)
+}
+
+func lastLines(output []byte, n int) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// prune removes the least recently completed videos until the cache fits
+// within HLSCacheMB, skipping any with a transcode in progress.
+func (t *Transcoder) prune() {
+	type video struct {
+		dir     string
+		size    int64
+		modTime time.Time
+	}
+
+	entries, err := os.ReadDir(t.cfg.HLSCachePath)
+	if err != nil {
+		log.Printf("Error reading HLS cache: %v", err)
+		return
+	}
+
+	t.mu.Lock()
+	busy := make(map[string]bool)
+	for dir := range t.active {
+		busy[filepath.Dir(dir)] = true
+	}
+	t.mu.Unlock()
+
+	var videos []video
+	var total int64
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		v := video{dir: filepath.Join(t.cfg.HLSCachePath, e.Name())}
+		filepath.Walk(v.dir, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				v.size += info.Size()
+				if info.ModTime().After(v.modTime) {
+					v.modTime = info.ModTime()
+				}
+			}
+			return nil
+		})
+		total += v.size
+		if !busy[v.dir] {
+			videos = append(videos, v)
+		}
+	}
+
+	sort.Slice(videos, func(i, j int) bool { return videos[i].modTime.Before(videos[j].modTime) })
+	limit := t.cfg.HLSCacheMB * 1024 * 1024
+	for _, v := range videos {
+		if total <= limit {
+			break
+		}
+		if err := os.RemoveAll(v.dir); err != nil {
+			log.Printf("Error pruning HLS cache %s: %v", v.dir, err)
+			continue
+		}
+		total -= v.size
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ImageRequest describes an on-demand rendition of a photo.
+type ImageRequest struct {
+	Width   int
+	Height  int
+	Fit     string
+	Format  string
+	Quality int
+
+	// Metadata lists the kinds kept from the source, per rendition_metadata
+	Metadata []string
+}
+
+// ParseImageRequest validates the w, h, fit, fmt and q query parameters.
+// maxSize bounds both dimensions. Format and Quality are left empty when
+// not requested so the caller can negotiate them.
+func ParseImageRequest(get func(string) string, maxSize int) (*ImageRequest, error) {
+	req := &ImageRequest{Fit: "inside"}
+
+	for _, dim := range []struct {
+		name string
+		dst  *int
+	}{{"w", &req.Width}, {"h", &req.Height}} {
+		v := get(dim.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxSize {
+			return nil, fmt.Errorf("%s must be between 1 and %d", dim.name, maxSize)
+		}
+		*dim.dst = n
+	}
+	if req.Width == 0 && req.Height == 0 {
+		return nil, fmt.Errorf("w or h is required")
+	}
+
+	if v := get("fit"); v != "" {
+		switch v {
+		case "inside", "cover", "fill":
+			req.Fit = v
+		default:
+			return nil, fmt.Errorf("fit must be inside, cover or fill")
+		}
+	}
+	if req.Fit != "inside" && (req.Width == 0 || req.Height == 0) {
+		return nil, fmt.Errorf("fit=%s requires both w and h", req.Fit)
+	}
+
+	if v := get("fmt"); v != "" {
+		if v == "jpg" {
+			v = "jpeg"
+		}
+		if !isImageFormat(v) {
+			return nil, fmt.Errorf("fmt must be jpeg, png, webp or avif")
+		}
+		req.Format = v
+	}
+
+	if v := get("q"); v != "" {
+		q, err := strconv.Atoi(v)
+		if err != nil || q < 1 || q > 100 {
+			return nil, fmt.Errorf("q must be between 1 and 100")
+		}
+		req.Quality = q
+	}
+
+	return req, nil
+}
+
+func (r *ImageRequest) geometry() string {
+	w, h := "", ""
+	if r.Width > 0 {
+		w = strconv.Itoa(r.Width)
+	}
+	if r.Height > 0 {
+		h = strconv.Itoa(r.Height)
+	}
+	switch r.Fit {
+	case "cover":
+		return w + "x" + h + "^"
+	case "fill":
+		return w + "x" + h + "!"
+	default:
+		return w + "x" + h + ">"
+	}
+}
+
+func (r *ImageRequest) convertArgs(src, dst string) []string {
+	args := []string{src, "-resize", r.geometry()}
+	if r.Fit == "cover" {
+		args = append(args, "-gravity", "center", "-extent", fmt.Sprintf("%dx%d", r.Width, r.Height))
+	}
+	args = append(args, metadataArgs(r.Metadata)...)
+	return append(args, "-quality", strconv.Itoa(r.Quality), r.Format+":"+dst)
+}
+
+// cacheKey is unique per photo version and request. srcMod is the
+// modification time of the rendition rendered from, so a regenerated
+// thumbnail, such as a new video poster, never hits a stale entry.
+func (r *ImageRequest) cacheKey(p *Photo, srcMod time.Time) string {
+	return fmt.Sprintf("%d/%d-%d-%dx%d-%s-q%d-m%s.%s", p.ID, p.ModTime.Unix(), srcMod.UnixNano(), r.Width, r.Height, r.Fit, r.Quality, strings.Join(r.Metadata, "+"), formatExtension(r.Format))
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+type renderCall struct {
+	done chan struct{}
+	err  error
+}
+
+// ImageCache is a size-bounded disk cache of on-demand renditions with LRU
+// eviction. Concurrent requests for the same rendition share one render.
+type ImageCache struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	lru      *list.List
+	entries  map[string]*list.Element
+	size     int64
+	inflight map[string]*renderCall
+}
+
+func NewImageCache(dir string, maxBytes int64) (*ImageCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create image cache directory: %w", err)
+	}
+
+	c := &ImageCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		inflight: make(map[string]*renderCall),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load indexes files left by a previous run, oldest first, so eviction
+// order survives restarts approximately.
+func (c *ImageCache) load() error {
+	type existing struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var files []existing
+
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		key, err := filepath.Rel(c.dir, path)
+		if err != nil {
+			return nil
+		}
+		files = append(files, existing{filepath.ToSlash(key), info.Size(), info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index image cache: %w", err)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		c.entries[f.key] = c.lru.PushFront(&cacheEntry{key: f.key, size: f.size})
+		c.size += f.size
+	}
+	c.evict()
+	return nil
+}
+
+func (c *ImageCache) path(key string) string {
+	return filepath.Join(c.dir, filepath.FromSlash(key))
+}
+
+// Get returns the path of the cached rendition for key, calling render to
+// produce it on a miss.
+func (c *ImageCache) Get(key string, render func(dst string) error) (string, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		c.mu.Unlock()
+		return c.path(key), nil
+	}
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return c.path(key), call.err
+	}
+	call := &renderCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	size, err := c.render(key, render)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if err == nil {
+		c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: size})
+		c.size += size
+		c.evict()
+	}
+	c.mu.Unlock()
+
+	call.err = err
+	close(call.done)
+	return c.path(key), err
+}
+
+func (c *ImageCache) render(key string, render func(dst string) error) (int64, error) {
+	dst := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+
+	tmp := dst + ".tmp"
+	defer os.Remove(tmp)
+	if err := render(tmp); err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Trim evicts entries until the cache fits its size limit.
+func (c *ImageCache) Trim() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict()
+}
+
+// evict removes least recently used entries until the cache fits. The
+// caller must hold c.mu.
+func (c *ImageCache) evict() {
+	for c.size > c.maxBytes && c.lru.Len() > 0 {
+		el := c.lru.Back()
+		entry := el.Value.(*cacheEntry)
+		c.lru.Remove(el)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+		if err := os.Remove(c.path(entry.key)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error evicting %s from image cache: %v", entry.key, err)
+		}
+	}
+}
+
+func renderImage(src, dst string, req *ImageRequest) error {
+	cmd := exec.Command("convert", req.convertArgs(src, dst)...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("convert failed: %w: %s", err, output)
+	}
+	return nil
+}
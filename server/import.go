@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// DefaultImportTemplate files imports by capture date and names them after
+// the camera and the number in the camera's own file name.
+const DefaultImportTemplate = "{date:2006/01-02}/{camera}_{seq}{ext}"
+
+// maxImportErrors caps the per-file errors kept in an import's status.
+const maxImportErrors = 100
+
+var (
+	errImportRunning = errors.New("an import is already running")
+	errImportIdle    = errors.New("no import is running")
+	errImportSource  = errors.New("source is not in import_sources")
+	errSourceInside  = errors.New("source is inside originals_path")
+)
+
+var templateToken = regexp.MustCompile(`\{(\w+)(?::([^}]*))?\}`)
+
+// importVars are the values a template is expanded with.
+type importVars struct {
+	Date   time.Time
+	Camera string
+	Seq    string
+	Name   string
+	Ext    string
+}
+
+// expandImportTemplate builds the path, relative to the originals, that a
+// file is imported to. Supported tokens are {date} with an optional Go time
+// layout, {camera}, {seq}, {name} and {ext}.
+func expandImportTemplate(tmpl string, v importVars) (string, error) {
+	var err error
+	path := templateToken.ReplaceAllStringFunc(tmpl, func(token string) string {
+		m := templateToken.FindStringSubmatch(token)
+		switch m[1] {
+		case "date":
+			if m[2] == "" {
+				return v.Date.Format("2006-01-02")
+			}
+			return v.Date.Format(m[2])
+		case "camera":
+			return v.Camera
+		case "seq":
+			return v.Seq
+		case "name":
+			return v.Name
+		case "ext":
+			return v.Ext
+		}
+		err = fmt.Errorf("unknown import_template token %s", token)
+		return token
+	})
+	if err != nil {
+		return "", err
+	}
+	path = filepath.FromSlash(path)
+	if !filepath.IsLocal(path) || strings.SplitN(path, string(filepath.Separator), 2)[0] == trashDirName {
+		return "", fmt.Errorf("import_template must produce a path inside originals_path, got %q", path)
+	}
+	return path, nil
+}
+
+// validateImportTemplate checks a template with sample values, so mistakes
+// show up when the config is loaded rather than halfway through a card.
+func validateImportTemplate(tmpl string) error {
+	if !strings.Contains(tmpl, "{ext}") {
+		return fmt.Errorf("import_template must include {ext} so files keep their type")
+	}
+	_, err := expandImportTemplate(tmpl, importVars{Date: time.Now(), Camera: "Camera", Seq: "0001", Name: "IMG_0001", Ext: ".jpg"})
+	return err
+}
+
+// importSeq returns the number at the end of a camera file name, such as
+// 1234 for IMG_1234, or the whole name if it has none. RAW+JPEG pairs share
+// it, so they keep matching names and stay companions.
+func importSeq(stem string) string {
+	i := len(stem)
+	for i > 0 && stem[i-1] >= '0' && stem[i-1] <= '9' {
+		i--
+	}
+	if i == len(stem) {
+		return stem
+	}
+	return stem[i:]
+}
+
+// importCamera turns a camera model into a file name part.
+func importCamera(meta *photoMetadata) string {
+	camera := meta.CameraModel
+	if camera == "" {
+		camera = meta.CameraMake
+	}
+	parts := strings.FieldsFunc(camera, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_'
+	})
+	if len(parts) == 0 {
+		return "Unknown"
+	}
+	return strings.Join(parts, "-")
+}
+
+// ImportStatus is the progress of an import, reported by GET /api/import.
+type ImportStatus struct {
+	Source     string     `json:"source"`
+	State      string     `json:"state"`
+	Total      int        `json:"total"`
+	TotalBytes int64      `json:"total_bytes"`
+	Processed  int        `json:"processed"`
+	Bytes      int64      `json:"bytes"`
+	Copied     int        `json:"copied"`
+	Skipped    int        `json:"skipped"`
+	Failed     int        `json:"failed"`
+	Current    string     `json:"current,omitempty"`
+	Errors     []string   `json:"errors,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Importer copies new files from a card or dump folder into the originals.
+// One import runs at a time; the status of the last one is kept.
+type Importer struct {
+	cfg     *Config
+	scanner *Scanner
+
+	mu     sync.Mutex
+	status *ImportStatus
+	cancel context.CancelFunc
+}
+
+func NewImporter(cfg *Config, scanner *Scanner) *Importer {
+	return &Importer{cfg: cfg, scanner: scanner}
+}
+
+// Status returns a copy of the current or last import's status, or one in
+// the "idle" state if nothing has been imported since startup.
+func (im *Importer) Status() *ImportStatus {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if im.status == nil {
+		return &ImportStatus{State: "idle"}
+	}
+	st := *im.status
+	st.Errors = append([]string(nil), im.status.Errors...)
+	return &st
+}
+
+func (im *Importer) update(fn func(st *ImportStatus)) {
+	im.mu.Lock()
+	fn(im.status)
+	im.mu.Unlock()
+}
+
+// Start imports source in the background. Over the API, sources must be at
+// or below one of import_sources.
+func (im *Importer) Start(source string) (*ImportStatus, error) {
+	source, err := im.allowedSource(source)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel, err := im.begin(context.Background(), source)
+	if err != nil {
+		return nil, err
+	}
+	go im.run(ctx, cancel, source)
+	return im.Status(), nil
+}
+
+// Import imports source and waits for it to finish.
+func (im *Importer) Import(ctx context.Context, source string) (*ImportStatus, error) {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel, err := im.begin(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	im.run(ctx, cancel, source)
+	st := im.Status()
+	if st.Error != "" {
+		return st, errors.New(st.Error)
+	}
+	return st, nil
+}
+
+// Cancel stops a running import after the file being copied.
+func (im *Importer) Cancel() error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if im.status == nil || im.status.State != "running" {
+		return errImportIdle
+	}
+	im.cancel()
+	return nil
+}
+
+// begin marks an import of source as running. The returned cancel func
+// belongs to this import alone; im.cancel is replaced by the next one.
+func (im *Importer) begin(ctx context.Context, source string) (context.Context, context.CancelFunc, error) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if im.status != nil && im.status.State == "running" {
+		return nil, nil, errImportRunning
+	}
+	ctx, im.cancel = context.WithCancel(ctx)
+	im.status = &ImportStatus{Source: source, State: "running", StartedAt: time.Now()}
+	return ctx, im.cancel, nil
+}
+
+// allowedSource resolves source and checks it against import_sources.
+func (im *Importer) allowedSource(source string) (string, error) {
+	if !filepath.IsAbs(source) {
+		return "", errImportSource
+	}
+	real, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return "", err
+	}
+	for _, allowed := range im.cfg.ImportSources {
+		root, err := filepath.EvalSymlinks(allowed)
+		if err != nil {
+			continue
+		}
+		if real == root || strings.HasPrefix(real, root+string(filepath.Separator)) {
+			return real, nil
+		}
+	}
+	return "", errImportSource
+}
+
+func (im *Importer) run(ctx context.Context, cancel context.CancelFunc, source string) {
+	defer cancel()
+	err := im.importAll(ctx, source)
+	im.update(func(st *ImportStatus) {
+		now := time.Now()
+		st.FinishedAt, st.Current = &now, ""
+		switch {
+		case errors.Is(err, context.Canceled):
+			st.State = "cancelled"
+		case err != nil:
+			st.State, st.Error = "failed", err.Error()
+		default:
+			st.State = "done"
+		}
+		log.Printf("Import of %s %s: %d copied, %d skipped, %d failed", st.Source, st.State, st.Copied, st.Skipped, st.Failed)
+	})
+}
+
+// importAll lists the supported files in source, then imports them in name
+// order so pairs and sequences stay together.
+func (im *Importer) importAll(ctx context.Context, source string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errNotFolder
+	}
+	if rel, err := filepath.Rel(im.cfg.OriginalsPath, source); err == nil && filepath.IsLocal(rel) {
+		return errSourceInside
+	}
+
+	type sourceFile struct {
+		path string
+		info fs.FileInfo
+	}
+	var files []sourceFile
+	var total int64
+	err = filepath.WalkDir(source, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Error reading %s: %v", path, err)
+			return nil
+		}
+		// Cards carry hidden system folders and macOS ._ resource files
+		if strings.HasPrefix(d.Name(), ".") && path != source {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !d.Type().IsRegular() || !im.scanner.isSupportedExtension(strings.ToLower(filepath.Ext(path))) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, sourceFile{path, info})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	im.update(func(st *ImportStatus) { st.Total, st.TotalBytes = len(files), total })
+
+	seen := make(map[string]bool)
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		im.update(func(st *ImportStatus) { st.Current = f.path })
+
+		copied, err := im.importFile(f.path, f.info, seen)
+		im.update(func(st *ImportStatus) {
+			st.Processed++
+			st.Bytes += f.info.Size()
+			switch {
+			case err != nil:
+				st.Failed++
+				if len(st.Errors) < maxImportErrors {
+					st.Errors = append(st.Errors, fmt.Sprintf("%s: %v", f.path, err))
+				}
+			case copied:
+				st.Copied++
+			default:
+				st.Skipped++
+			}
+		})
+		if err != nil {
+			log.Printf("Error importing %s: %v", f.path, err)
+		}
+	}
+	return nil
+}
+
+// importFile copies one file into place and indexes it. It returns false
+// without error when the library already has the same content.
+func (im *Importer) importFile(src string, info fs.FileInfo, seen map[string]bool) (bool, error) {
+	// Only sizes the library already has can be duplicates, so only those
+	// files are read an extra time to hash them before copying
+	var known string
+	if candidates, err := im.scanner.db.PhotosBySize(info.Size()); err != nil {
+		return false, err
+	} else if len(candidates) > 0 {
+		if known, err = fileHash(src); err != nil {
+			return false, err
+		}
+		dup, err := im.scanner.FindDuplicate(info.Size(), known)
+		if err != nil {
+			return false, err
+		}
+		if dup != nil {
+			return false, nil
+		}
+	}
+
+	name := filepath.Base(src)
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	meta := im.scanner.captureInfo(src, name)
+	date := info.ModTime()
+	if meta.CapturedAt != nil {
+		date = *meta.CapturedAt
+	}
+	rel, err := expandImportTemplate(im.cfg.ImportTemplate, importVars{
+		Date:   date,
+		Camera: importCamera(meta),
+		Seq:    importSeq(stem),
+		Name:   stem,
+		Ext:    ext,
+	})
+	if err != nil {
+		return false, err
+	}
+	dest := filepath.Join(im.cfg.OriginalsPath, rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return false, err
+	}
+
+	// Copy under a hidden name the scanner skips, then check the copy
+	// against what was read from the card before it becomes visible
+	tmp := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".importing")
+	hash, err := copyHashed(src, tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	if written, err := fileHash(tmp); err != nil || written != hash || known != "" && known != hash {
+		os.Remove(tmp)
+		if err != nil {
+			return false, err
+		}
+		return false, fmt.Errorf("copy does not match the source")
+	}
+	if seen[hash] {
+		os.Remove(tmp)
+		return false, nil
+	}
+	seen[hash] = true
+
+	// An earlier import may have placed the file without indexing it
+	if existing, err := fileHash(dest); err == nil && existing == hash {
+		os.Remove(tmp)
+		return false, nil
+	}
+	result, err := im.scanner.Place(tmp, dest, info.Size(), hash)
+	if err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	if result.Duplicate {
+		return false, nil
+	}
+	log.Printf("Imported %s to %s", src, result.Path)
+	return true, nil
+}
+
+// copyHashed copies src to a new file dst, synced to disk with the source's
+// modification time, and returns the hex SHA-256 of the data read.
+func copyHashed(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(out, io.TeeReader(in, h)); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	os.Chtimes(dst, info.ModTime(), info.ModTime())
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
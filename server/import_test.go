@@ -0,0 +1,98 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpandImportTemplate(t *testing.T) {
+	v := importVars{
+		Date:   time.Date(2024, 7, 9, 14, 30, 0, 0, time.UTC),
+		Camera: "ILCE-7M4",
+		Seq:    "01234",
+		Name:   "DSC01234",
+		Ext:    ".ARW",
+	}
+	tests := []struct {
+		tmpl string
+		want string // empty for an error
+	}{
+		{DefaultImportTemplate, "2024/07-09/ILCE-7M4_01234.ARW"},
+		{"{date}/{name}{ext}", "2024-07-09/DSC01234.ARW"},
+		{"{date:2006}/{date:Jan}/{name}{ext}", "2024/Jul/DSC01234.ARW"},
+		{"imports/{camera}/{seq}{ext}", "imports/ILCE-7M4/01234.ARW"},
+		{"{name}", "DSC01234"},
+		{"{date}/{lens}{ext}", ""},
+		{"../{name}{ext}", ""},
+		{"/{name}{ext}", ""},
+		{".trash/{name}{ext}", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, err := expandImportTemplate(tt.tmpl, v)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("expandImportTemplate(%q) = %q, want error", tt.tmpl, got)
+		case tt.want != "" && err != nil:
+			t.Errorf("expandImportTemplate(%q): %v", tt.tmpl, err)
+		case tt.want != "" && got != filepath.FromSlash(tt.want):
+			t.Errorf("expandImportTemplate(%q) = %q, want %q", tt.tmpl, got, tt.want)
+		}
+	}
+}
+
+func TestValidateImportTemplate(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		ok   bool
+	}{
+		{DefaultImportTemplate, true},
+		{"{date}/{name}{ext}", true},
+		{"{date}/{name}", false},
+		{"{date}/{bogus}{ext}", false},
+		{"../{name}{ext}", false},
+	}
+	for _, tt := range tests {
+		if err := validateImportTemplate(tt.tmpl); (err == nil) != tt.ok {
+			t.Errorf("validateImportTemplate(%q) = %v, want ok %v", tt.tmpl, err, tt.ok)
+		}
+	}
+}
+
+func TestImportSeq(t *testing.T) {
+	tests := []struct {
+		stem, want string
+	}{
+		{"IMG_1234", "1234"},
+		{"DSC01234", "01234"},
+		{"_MG_0042", "0042"},
+		{"1234", "1234"},
+		{"IMG_1234 copy", "IMG_1234 copy"},
+		{"PXL_20240709_143000123", "143000123"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := importSeq(tt.stem); got != tt.want {
+			t.Errorf("importSeq(%q) = %q, want %q", tt.stem, got, tt.want)
+		}
+	}
+}
+
+func TestImportCamera(t *testing.T) {
+	tests := []struct {
+		meta photoMetadata
+		want string
+	}{
+		{photoMetadata{CameraMake: "Canon", CameraModel: "Canon EOS R5"}, "Canon-EOS-R5"},
+		{photoMetadata{CameraMake: "SONY", CameraModel: "ILCE-7M4"}, "ILCE-7M4"},
+		{photoMetadata{CameraMake: "Apple"}, "Apple"},
+		{photoMetadata{CameraModel: "X100V / Fuji"}, "X100V-Fuji"},
+		{photoMetadata{}, "Unknown"},
+	}
+	for _, tt := range tests {
+		if got := importCamera(&tt.meta); got != tt.want {
+			t.Errorf("importCamera(%+v) = %q, want %q", tt.meta, got, tt.want)
+		}
+	}
+}
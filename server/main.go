@@ -4,31 +4,92 @@ import (
 	"context"
 	"crypto/subtle"
 	"encoding/json"
-	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// commands maps subcommand names to their implementations. Everything but
+// serve runs to completion and exits, so it can be used from cron or a
+// shell while the server is stopped or running.
+var commands = map[string]func(args []string) error{
+	"serve":              runServe,
+	"scan":               runScan,
+	"rebuild-thumbnails": runRebuildThumbnails,
+	"verify":             runVerify,
+	"stats":              runStats,
+	"config":             runConfig,
+	"prune":              runPrune,
+	"import":             runImport,
+	"backup":             runBackup,
+	"restore":            runRestore,
+}
+
 func main() {
-	configPath := flag.String("config", "config.json", "Path to configuration file")
-	flag.Parse()
+	// Without a subcommand, serve as before: glimpse-server -config config.json
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, usage)
+		os.Exit(2)
+	}
+	if err := cmd(args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+const usage = `Usage: glimpse-server <command> [-config config.json] [options]
+
+Commands:
+  serve                  Run the HTTP server and periodic scanner (default)
+  scan [-path dir] [-force]
+                         Scan originals once, optionally a subdirectory or ignoring up-to-date rows
+  rebuild-thumbnails [-path dir]
+                         Regenerate thumbnails and metadata for indexed items
+  verify [-repair missing,changed,thumbnails,orphans|all] [-force] [-json]
+                         Cross-check the database against disk and optionally repair
+  stats                  Print library statistics
+  config init|validate|print
+                         Write a default config, check one, or print the effective settings
+  prune [-force]         Remove rows for deleted originals and trim caches and backups
+  import <dir>           Copy new photos and videos from a card or folder into the originals
+  backup [-o file]       Write a consistent database snapshot
+  restore <file>         Replace the database with a backup
+`
+
+func runServe(args []string) error {
+	fs, configPath := commandFlags("serve")
+	fs.Parse(args)
 
 	cfg, err := LoadConfig(*configPath)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		return fmt.Errorf("failed to load config: %w", err)
 	}
 
 	db, err := NewDatabase(cfg.DatabasePath)
 	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
+		return fmt.Errorf("failed to open database: %w", err)
 	}
 	defer db.Close()
 
-	scanner := NewScanner(cfg, db)
+	geocoder, err := NewGeocoder(cfg.GazetteerPath, cfg.GeocodeMaxKm)
+	if err != nil {
+		return fmt.Errorf("failed to load gazetteer: %w", err)
+	}
+
+	go scheduleBackups(cfg, db)
+
+	thumbs := NewThumbnailCache(cfg.ThumbnailCacheMB * 1024 * 1024)
+	scanner := NewScanner(cfg, db, thumbs, geocoder)
 
 	// Start initial scan
 	go func() {
@@ -52,21 +113,64 @@ func main() {
 		}
 	}()
 
+	images, err := NewImageCache(cfg.ImageCachePath, cfg.ImageCacheMB*1024*1024)
+	if err != nil {
+		return fmt.Errorf("failed to open image cache: %w", err)
+	}
+
+	transcoder, err := NewTranscoder(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to set up transcoder: %w", err)
+	}
+
+	uploads, err := NewUploader(cfg, scanner)
+	if err != nil {
+		return fmt.Errorf("failed to set up uploads: %w", err)
+	}
+
 	// Setup HTTP server
-	handler := NewHandler(cfg, db, scanner)
+	handler := NewHandler(cfg, db, scanner, images, thumbs, transcoder, uploads, NewImporter(cfg, scanner))
 	mux := http.NewServeMux()
 
 	// API routes
 	mux.HandleFunc("GET /api/photos", handler.ListPhotos)
 	mux.HandleFunc("GET /api/photos/{id}", handler.GetPhoto)
 	mux.HandleFunc("GET /api/photos/{id}/thumbnail", handler.GetThumbnail)
+	mux.HandleFunc("GET /api/photos/{id}/image", handler.GetImage)
 	mux.HandleFunc("GET /api/photos/{id}/original", handler.GetOriginal)
+	mux.HandleFunc("POST /api/download", handler.Download)
 	mux.HandleFunc("GET /api/photos/{id}/stream", handler.StreamVideo)
+	mux.HandleFunc("GET /api/photos/{id}/playback", handler.GetPlayback)
+	mux.HandleFunc("GET /api/photos/{id}/hls/master.m3u8", handler.GetHLSMaster)
+	mux.HandleFunc("GET /api/photos/{id}/hls/{rendition}/{file}", handler.GetHLSFile)
+	mux.HandleFunc("GET /api/photos/{id}/preview", handler.GetVideoPreview)
+	mux.HandleFunc("GET /api/photos/{id}/scrub", handler.GetScrubStrip)
+	mux.HandleFunc("GET /api/photos/{id}/scrub/index", handler.GetScrubIndex)
+	mux.HandleFunc("POST /api/photos/{id}/poster", requireAPIKey(handler.SetPoster))
+	mux.HandleFunc("POST /api/photos/{id}/move", requireAPIKey(handler.MovePhoto))
+	mux.HandleFunc("DELETE /api/photos/{id}", requireAPIKey(handler.DeletePhoto))
+	mux.HandleFunc("GET /api/trash", handler.ListTrash)
+	mux.HandleFunc("POST /api/trash/{id}/restore", requireAPIKey(handler.RestorePhoto))
+	mux.HandleFunc("POST /api/thumbnails/batch", handler.BatchThumbnails)
 	mux.HandleFunc("GET /api/folders", handler.ListFolders)
+	mux.HandleFunc("POST /api/folders", requireAPIKey(handler.CreateFolder))
+	mux.HandleFunc("POST /api/folders/move", requireAPIKey(handler.MoveFolder))
+	mux.HandleFunc("GET /api/folders/sprite", handler.GetFolderSprite)
+	mux.HandleFunc("GET /api/folders/sprite/index", handler.GetFolderSpriteIndex)
+	mux.HandleFunc("GET /api/places", handler.GetPlaces)
+	mux.HandleFunc("GET /api/map", handler.GetMap)
+	mux.HandleFunc("OPTIONS /api/upload", handler.UploadOptions)
+	mux.HandleFunc("POST /api/upload", requireAPIKey(handler.CreateUpload))
+	mux.HandleFunc("HEAD /api/upload/{id}", requireAPIKey(handler.GetUploadOffset))
+	mux.HandleFunc("PATCH /api/upload/{id}", requireAPIKey(handler.PatchUpload))
+	mux.HandleFunc("DELETE /api/upload/{id}", requireAPIKey(handler.DeleteUpload))
+	mux.HandleFunc("POST /api/import", requireAPIKey(handler.StartImport))
+	mux.HandleFunc("GET /api/import", handler.GetImport)
+	mux.HandleFunc("DELETE /api/import", requireAPIKey(handler.CancelImport))
 	mux.HandleFunc("GET /api/stats", handler.GetStats)
 	mux.HandleFunc("POST /api/scan", handler.TriggerScan)
 
-	corsHandler := corsMiddleware(apiKeyMiddleware(cfg.APIKey, mux))
+	corsHandler := corsMiddleware(apiKeyMiddleware(cfg.APIKey, cfg.APIKeys, mux))
 
 	server := &http.Server{
 		Addr:    cfg.ListenAddr,
@@ -77,14 +181,19 @@ func main() {
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGTERM)
 
+	serveErr := make(chan error, 1)
 	go func() {
 		log.Printf("Server starting on %s", cfg.ListenAddr)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server error: %v", err)
+			serveErr <- err
 		}
 	}()
 
-	<-done
+	select {
+	case <-done:
+	case err := <-serveErr:
+		return fmt.Errorf("server error: %w", err)
+	}
 	log.Println("Shutting down...")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -93,15 +202,18 @@ func main() {
 	if err := server.Shutdown(ctx); err != nil {
 		log.Printf("Shutdown error: %v", err)
 	}
+	return nil
 }
 
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, If-None-Match, If-Modified-Since, Range, Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata, Upload-Checksum")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Content-Range, Accept-Ranges, Content-Disposition, Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, X-Photo-ID, X-Duplicate")
 
-		if r.Method == "OPTIONS" {
+		// Plain OPTIONS requests reach the mux for tus discovery
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -110,16 +222,46 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func apiKeyMiddleware(apiKey string, next http.Handler) http.Handler {
-	expected := []byte(apiKey)
+// apiKeyMiddleware accepts the main api_key with full access and any of the
+// additional keys with their own settings. The matching client is stored in
+// the request context.
+func apiKeyMiddleware(apiKey string, clients []APIClient, next http.Handler) http.Handler {
+	if apiKey != "" {
+		clients = append([]APIClient{{Name: "default", Key: apiKey, Write: true}}, clients...)
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(clients) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		provided := []byte(r.Header.Get("X-API-Key"))
-		if len(expected) > 0 && subtle.ConstantTimeCompare(provided, expected) != 1 {
+		var client *APIClient
+		for i := range clients {
+			// Compare against every key so timing does not reveal which matched
+			if subtle.ConstantTimeCompare(provided, []byte(clients[i].Key)) == 1 && client == nil {
+				client = &clients[i]
+			}
+		}
+		if client == nil {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusUnauthorized)
 			json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
 			return
 		}
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, withAPIClient(r, client))
 	})
 }
+
+// requireAPIKey guards endpoints that change files on disk. They stay
+// disabled until an api_key is configured, whatever the network setup, and
+// only the api_key itself or api_keys with write set may use them.
+func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if client := apiClient(r); client == nil || !client.Write {
+			http.Error(w, "File management requires an API key with write access", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// migration is one numbered schema step. Steps run in order inside their
+// own transaction, which also records the new version, so a failed step
+// leaves the schema as it was.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrations must only ever be appended to. Steps 2 to 6 replace the old
+// unversioned ALTER TABLE list, so they add columns only when missing.
+var migrations = []migration{
+	{1, "create photos", func(tx *sql.Tx) error {
+		return execAll(tx,
+			`CREATE TABLE IF NOT EXISTS photos (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				original_path TEXT UNIQUE NOT NULL,
+				thumbnail_path TEXT NOT NULL,
+				folder TEXT NOT NULL,
+				filename TEXT NOT NULL,
+				extension TEXT NOT NULL,
+				file_size INTEGER NOT NULL,
+				mod_time DATETIME NOT NULL,
+				width INTEGER DEFAULT 0,
+				height INTEGER DEFAULT 0,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_photos_folder ON photos(folder)`,
+			`CREATE INDEX IF NOT EXISTS idx_photos_mod_time ON photos(mod_time)`,
+			`CREATE INDEX IF NOT EXISTS idx_photos_filename ON photos(filename)`,
+		)
+	}},
+	{2, "video columns", func(tx *sql.Tx) error {
+		return addColumns(tx, "photos", [][2]string{
+			{"media_type", "TEXT NOT NULL DEFAULT 'photo'"},
+			{"duration", "REAL DEFAULT 0"},
+			{"video_codec", "TEXT DEFAULT ''"},
+			{"audio_codec", "TEXT DEFAULT ''"},
+			{"framerate", "REAL DEFAULT 0"},
+		}, `CREATE INDEX IF NOT EXISTS idx_photos_media_type ON photos(media_type)`)
+	}},
+	{3, "renditions and placeholders", func(tx *sql.Tx) error {
+		return addColumns(tx, "photos", [][2]string{
+			{"renditions", "TEXT NOT NULL DEFAULT ''"},
+			{"thumbhash", "TEXT NOT NULL DEFAULT ''"},
+			{"aspect_ratio", "REAL DEFAULT 0"},
+			{"poster_time", "REAL"},
+		})
+	}},
+	{4, "capture metadata", func(tx *sql.Tx) error {
+		return addColumns(tx, "photos", [][2]string{
+			{"rotation", "INTEGER DEFAULT 0"},
+			{"color_transfer", "TEXT DEFAULT ''"},
+			{"hdr_format", "TEXT DEFAULT ''"},
+			{"bitrate", "INTEGER DEFAULT 0"},
+			{"captured_at", "DATETIME"},
+			{"latitude", "REAL"},
+			{"longitude", "REAL"},
+			{"altitude", "REAL"},
+			{"camera_make", "TEXT DEFAULT ''"},
+			{"camera_model", "TEXT DEFAULT ''"},
+			{"audio_channels", "INTEGER DEFAULT 0"},
+		})
+	}},
+	{5, "geohash", func(tx *sql.Tx) error {
+		return addColumns(tx, "photos", [][2]string{
+			{"geohash", "TEXT NOT NULL DEFAULT ''"},
+			{"metadata_read", "INTEGER NOT NULL DEFAULT 0"},
+		}, `CREATE INDEX IF NOT EXISTS idx_photos_geohash ON photos(geohash) WHERE geohash != ''`)
+	}},
+	{6, "places", func(tx *sql.Tx) error {
+		return addColumns(tx, "photos", [][2]string{
+			{"country", "TEXT NOT NULL DEFAULT ''"},
+			{"region", "TEXT NOT NULL DEFAULT ''"},
+			{"city", "TEXT NOT NULL DEFAULT ''"},
+		}, `CREATE INDEX IF NOT EXISTS idx_photos_place ON photos(country, region, city)`)
+	}},
+	{7, "soft delete", func(tx *sql.Tx) error {
+		return addColumns(tx, "photos", [][2]string{
+			{"deleted_at", "DATETIME"},
+		}, `CREATE INDEX IF NOT EXISTS idx_photos_deleted_at ON photos(deleted_at) WHERE deleted_at IS NOT NULL`)
+	}},
+	{8, "trash", func(tx *sql.Tx) error {
+		return addColumns(tx, "photos", [][2]string{
+			{"trash_path", "TEXT NOT NULL DEFAULT ''"},
+		})
+	}},
+	{9, "content hash", func(tx *sql.Tx) error {
+		return addColumns(tx, "photos", [][2]string{
+			{"content_hash", "TEXT NOT NULL DEFAULT ''"},
+		}, `CREATE INDEX IF NOT EXISTS idx_photos_file_size ON photos(file_size)`)
+	}},
+	{10, "legacy thumbnails", removeLegacyThumbnails},
+	{11, "reprobe videos", func(tx *sql.Tx) error {
+		// Rotations were read with the display matrix sign reversed
+		return execAll(tx, `UPDATE photos SET metadata_read = 0 WHERE media_type = 'video'`)
+	}},
+	{12, "video preview errors", func(tx *sql.Tx) error {
+		return addColumns(tx, "photos", [][2]string{
+			{"preview_error", "TEXT NOT NULL DEFAULT ''"},
+		})
+	}},
+}
+
+// latestSchemaVersion is the schema version this build migrates to.
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// removeLegacyThumbnails deletes the single-size thumbnails from before
+// renditions. Rows that were never rendered since still name theirs in
+// thumbnail_path; only those files are removed, never one that is an
+// original or a rendered row's thumbnail, and the scan regenerates the
+// rows since their rendition signature is outdated.
+func removeLegacyThumbnails(tx *sql.Tx) error {
+	rows, err := tx.Query(`
+		SELECT thumbnail_path FROM photos
+		WHERE renditions = '' AND thumbnail_path != ''
+		AND thumbnail_path NOT IN (SELECT original_path FROM photos)
+		AND thumbnail_path NOT IN (SELECT thumbnail_path FROM photos WHERE renditions != '')
+	`)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return err
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, path := range paths {
+		if strings.EqualFold(filepath.Ext(path), ".jpg") && os.Remove(path) == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Printf("Removed %d thumbnails left from before renditions", removed)
+	}
+	return execAll(tx, `UPDATE photos SET thumbnail_path = '' WHERE renditions = ''`)
+}
+
+func execAll(tx *sql.Tx, stmts ...string) error {
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumns adds each column that table does not have yet, then runs the
+// extra statements.
+func addColumns(tx *sql.Tx, table string, columns [][2]string, stmts ...string) error {
+	existing, err := tableColumns(tx, table)
+	if err != nil {
+		return err
+	}
+	for _, c := range columns {
+		if existing[c[0]] {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, c[0], c[1])); err != nil {
+			return fmt.Errorf("adding %s.%s: %w", table, c[0], err)
+		}
+	}
+	return execAll(tx, stmts...)
+}
+
+func tableColumns(tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// SchemaVersion returns the highest applied migration, or 0 for a database
+// that predates versioning. It does not modify the database.
+func (d *Database) SchemaVersion() (int, error) {
+	var tables int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'`).Scan(&tables)
+	if err != nil || tables == 0 {
+		return 0, err
+	}
+	var version int
+	err = d.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// migrate brings the schema up to date. It refuses to touch a database
+// written by a newer server, and snapshots an existing database before
+// changing it.
+func (d *Database) migrate() error {
+	current, err := d.SchemaVersion()
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	latest := latestSchemaVersion()
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this server supports (%d)", current, latest)
+	}
+	if current == latest {
+		return nil
+	}
+
+	var tables int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'photos'`).Scan(&tables); err != nil {
+		return err
+	}
+	if tables > 0 {
+		backup := fmt.Sprintf("%s.pre-v%d-%s.bak", d.path, latest, time.Now().Format("20060102-150405"))
+		if _, err := d.db.Exec(`VACUUM INTO ?`, backup); err != nil {
+			return fmt.Errorf("pre-migration backup failed: %w", err)
+		}
+		log.Printf("Backed up database to %s before migrating from schema %d to %d", backup, current, latest)
+	}
+
+	if _, err := d.db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`); err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := d.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		log.Printf("Applied migration %d: %s", m.version, m.name)
+	}
+	return nil
+}
+
+func (d *Database) applyMigration(m migration) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_version (version, name) VALUES (?, ?)`, m.version, m.name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// legacySchema is the photos table as created before schema versioning,
+// including the video columns added by the old ALTER TABLE list.
+const legacySchema = `
+	CREATE TABLE photos (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		original_path TEXT UNIQUE NOT NULL,
+		thumbnail_path TEXT NOT NULL,
+		folder TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		extension TEXT NOT NULL,
+		file_size INTEGER NOT NULL,
+		mod_time DATETIME NOT NULL,
+		width INTEGER DEFAULT 0,
+		height INTEGER DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		media_type TEXT NOT NULL DEFAULT 'photo',
+		duration REAL DEFAULT 0,
+		video_codec TEXT DEFAULT '',
+		audio_codec TEXT DEFAULT '',
+		framerate REAL DEFAULT 0
+	);
+	CREATE INDEX idx_photos_folder ON photos(folder);
+	CREATE INDEX idx_photos_mod_time ON photos(mod_time);
+	CREATE INDEX idx_photos_filename ON photos(filename);
+	CREATE INDEX idx_photos_media_type ON photos(media_type);
+`
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "photos.db")
+	original := filepath.Join(dir, "a.jpg")
+	thumb := filepath.Join(dir, "thumb.jpg")
+	for _, f := range []string{original, thumb} {
+		if err := os.WriteFile(f, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	legacy, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacy.Exec(legacySchema+`
+		INSERT INTO photos (original_path, thumbnail_path, folder, filename, extension, file_size, mod_time, width, height)
+		VALUES (?, ?, '', 'a.jpg', '.jpg', 1, '2020-01-01 00:00:00', 4000, 3000);
+		INSERT INTO photos (original_path, thumbnail_path, folder, filename, extension, file_size, mod_time)
+		VALUES ('/elsewhere/b.jpg', ?, '', 'b.jpg', '.jpg', 1, '2020-01-01 00:00:00')
+	`, original, thumb, original)
+	legacy.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	version, err := d.SchemaVersion()
+	if err != nil || version != latestSchemaVersion() {
+		t.Fatalf("schema version %d, %v; want %d", version, err, latestSchemaVersion())
+	}
+	p, err := d.GetPhotoByPath(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Width != 4000 || p.MediaType != "photo" || p.ThumbnailPath != "" || p.DeletedAt != nil {
+		t.Errorf("migrated row %+v", p)
+	}
+
+	// The legacy thumbnail goes, but not a file another row names as its
+	// thumbnail while being an original
+	if _, err := os.Stat(thumb); !os.IsNotExist(err) {
+		t.Errorf("legacy thumbnail not removed: %v", err)
+	}
+	if _, err := os.Stat(original); err != nil {
+		t.Errorf("original removed: %v", err)
+	}
+
+	backups, _ := filepath.Glob(path + ".pre-v*.bak")
+	if len(backups) != 1 {
+		t.Errorf("got backups %v, want one", backups)
+	}
+
+	// Migrating again is a no-op
+	if err := d.migrate(); err != nil {
+		t.Errorf("second migrate: %v", err)
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "photos.db")
+	d, err := NewDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.db.Exec(`INSERT INTO schema_version (version, name) VALUES (?, 'future')`, latestSchemaVersion()+1)
+	d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d, err := NewDatabase(path); err == nil {
+		d.Close()
+		t.Fatal("opened a database from a newer server")
+	} else if !strings.Contains(err.Error(), "newer") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"os/exec"
+)
+
+// generatePlaceholder computes a base64 ThumbHash of a thumbnail and its
+// aspect ratio, so clients can lay out and paint rows before images load.
+func generatePlaceholder(thumbPath string) (string, float64, error) {
+	var width, height int
+	output, err := exec.Command("identify", "-format", "%w %h", thumbPath+"[0]").Output()
+	if err != nil {
+		return "", 0, fmt.Errorf("identify failed: %w", err)
+	}
+	fmt.Sscanf(string(output), "%d %d", &width, &height)
+	if width == 0 || height == 0 {
+		return "", 0, fmt.Errorf("could not read dimensions of %s", thumbPath)
+	}
+
+	// ThumbHash input is limited to 100x100
+	output, err = exec.Command("convert", thumbPath+"[0]", "-resize", "100x100>", "png:-").Output()
+	if err != nil {
+		return "", 0, fmt.Errorf("convert failed: %w", err)
+	}
+	img, err := png.Decode(bytes.NewReader(output))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to decode placeholder source: %w", err)
+	}
+
+	hash := thumbHash(img)
+	return base64.StdEncoding.EncodeToString(hash), float64(width) / float64(height), nil
+}
+
+// jsRound matches JavaScript's Math.round, which the reference ThumbHash
+// encoder uses, so hashes are identical across implementations.
+func jsRound(x float64) int {
+	return int(math.Floor(x + 0.5))
+}
+
+// thumbHash encodes img (at most 100x100) following the reference
+// implementation at https://github.com/evanw/thumbhash.
+func thumbHash(img image.Image) []byte {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	n := w * h
+
+	rgba := make([]float64, 0, n*4)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a > 0 {
+				// Undo premultiplication
+				r, g, b = r*0xffff/a, g*0xffff/a, b*0xffff/a
+			}
+			rgba = append(rgba, float64(r>>8), float64(g>>8), float64(b>>8), float64(a>>8))
+		}
+	}
+
+	var avgR, avgG, avgB, avgA float64
+	for i := 0; i < n; i++ {
+		alpha := rgba[i*4+3] / 255
+		avgR += alpha / 255 * rgba[i*4]
+		avgG += alpha / 255 * rgba[i*4+1]
+		avgB += alpha / 255 * rgba[i*4+2]
+		avgA += alpha
+	}
+	if avgA > 0 {
+		avgR /= avgA
+		avgG /= avgA
+		avgB /= avgA
+	}
+
+	hasAlpha := avgA < float64(n)
+	lLimit := 7.0
+	if hasAlpha {
+		lLimit = 5
+	}
+	maxWH := float64(max(w, h))
+	lx := max(1, jsRound(lLimit*float64(w)/maxWH))
+	ly := max(1, jsRound(lLimit*float64(h)/maxWH))
+
+	l := make([]float64, n)
+	p := make([]float64, n)
+	q := make([]float64, n)
+	a := make([]float64, n)
+	for i := 0; i < n; i++ {
+		alpha := rgba[i*4+3] / 255
+		r := avgR*(1-alpha) + alpha/255*rgba[i*4]
+		g := avgG*(1-alpha) + alpha/255*rgba[i*4+1]
+		b := avgB*(1-alpha) + alpha/255*rgba[i*4+2]
+		l[i] = (r + g + b) / 3
+		p[i] = (r+g)/2 - b
+		q[i] = r - g
+		a[i] = alpha
+	}
+
+	encodeChannel := func(channel []float64, nx, ny int) (dc float64, ac []float64, scale float64) {
+		fx := make([]float64, w)
+		for cy := 0; cy < ny; cy++ {
+			for cx := 0; cx*ny < nx*(ny-cy); cx++ {
+				var f float64
+				for x := 0; x < w; x++ {
+					fx[x] = math.Cos(math.Pi / float64(w) * float64(cx) * (float64(x) + 0.5))
+				}
+				for y := 0; y < h; y++ {
+					fy := math.Cos(math.Pi / float64(h) * float64(cy) * (float64(y) + 0.5))
+					for x := 0; x < w; x++ {
+						f += channel[x+y*w] * fx[x] * fy
+					}
+				}
+				f /= float64(n)
+				if cx > 0 || cy > 0 {
+					ac = append(ac, f)
+					scale = math.Max(scale, math.Abs(f))
+				} else {
+					dc = f
+				}
+			}
+		}
+		if scale > 0 {
+			for i := range ac {
+				ac[i] = 0.5 + 0.5/scale*ac[i]
+			}
+		}
+		return dc, ac, scale
+	}
+
+	lDC, lAC, lScale := encodeChannel(l, max(3, lx), max(3, ly))
+	pDC, pAC, pScale := encodeChannel(p, 3, 3)
+	qDC, qAC, qScale := encodeChannel(q, 3, 3)
+	var aDC, aScale float64
+	var aAC []float64
+	if hasAlpha {
+		aDC, aAC, aScale = encodeChannel(a, 5, 5)
+	}
+
+	isLandscape := w > h
+	header24 := jsRound(63*lDC) | jsRound(31.5+31.5*pDC)<<6 | jsRound(31.5+31.5*qDC)<<12 | jsRound(31*lScale)<<18
+	if hasAlpha {
+		header24 |= 1 << 23
+	}
+	header16 := jsRound(63*pScale)<<3 | jsRound(63*qScale)<<9
+	if isLandscape {
+		header16 |= ly | 1<<15
+	} else {
+		header16 |= lx
+	}
+
+	hash := []byte{
+		byte(header24), byte(header24 >> 8), byte(header24 >> 16),
+		byte(header16), byte(header16 >> 8),
+	}
+	channels := [][]float64{lAC, pAC, qAC}
+	if hasAlpha {
+		hash = append(hash, byte(jsRound(15*aDC)|jsRound(15*aScale)<<4))
+		channels = append(channels, aAC)
+	}
+
+	acStart := len(hash)
+	acIndex := 0
+	for _, ac := range channels {
+		for _, f := range ac {
+			i := acStart + acIndex>>1
+			if i >= len(hash) {
+				hash = append(hash, 0)
+			}
+			hash[i] |= byte(jsRound(15*f) << ((acIndex & 1) << 2))
+			acIndex++
+		}
+	}
+	return hash
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func solidImage(w, h int, c color.Color) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func TestThumbHash(t *testing.T) {
+	tests := []struct {
+		name   string
+		img    image.Image
+		header []byte // leading bytes: DC terms, scales, shape and alpha
+		length int
+	}{
+		// Solid colours have no AC energy beyond rounding noise, so only
+		// the header is fixed
+		{"white", solidImage(4, 4, color.White), []byte{0x3f, 0x08, 0x02, 0x07, 0x00}, 24},
+		{"red", solidImage(4, 4, color.NRGBA{255, 0, 0, 255}), []byte{0xd5, 0xfb, 0x03, 0x07, 0x00}, 24},
+		{"landscape", solidImage(8, 4, color.White), []byte{0x3f, 0x08, 0x02, 0x04, 0x80}, 19},
+		// All-zero channels encode exactly, AC terms included
+		{"black", solidImage(4, 4, color.Black), append([]byte{0x00, 0x08, 0x02, 0x07, 0x00}, make([]byte, 19)...), 24},
+		{"transparent", solidImage(4, 4, color.Transparent), append([]byte{0x00, 0x08, 0x82, 0x05, 0x00, 0x00}, make([]byte, 19)...), 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash := thumbHash(tt.img)
+			if len(hash) != tt.length {
+				t.Errorf("got %d bytes, want %d", len(hash), tt.length)
+			}
+			if !bytes.HasPrefix(hash, tt.header) {
+				t.Errorf("got % x, want prefix % x", hash, tt.header)
+			}
+		})
+	}
+}
+
+func TestJSRound(t *testing.T) {
+	tests := []struct {
+		in   float64
+		want int
+	}{
+		{0.5, 1},
+		{1.5, 2},
+		{2.5, 3},
+		{-0.5, 0},
+		{-1.5, -1},
+		{31.5, 32},
+	}
+	for _, tt := range tests {
+		if got := jsRound(tt.in); got != tt.want {
+			t.Errorf("jsRound(%g) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"math"
+	"os/exec"
+)
+
+const posterCandidates = 6
+
+// posterCandidateTimes spreads candidate timestamps over the first half of
+// a video, past any opening fade. Without a known duration only the
+// historical one second mark is tried.
+func posterCandidateTimes(duration float64) []float64 {
+	if duration <= 0 {
+		return []float64{1}
+	}
+	times := make([]float64, posterCandidates)
+	for i := range times {
+		times[i] = duration * (0.05 + 0.45*float64(i)/float64(posterCandidates-1))
+	}
+	return times
+}
+
+// selectPosterTime samples candidate frames and returns the timestamp of
+// the best scoring one. Candidates that fail to decode are skipped.
+func selectPosterTime(videoPath string, duration float64) float64 {
+	times := posterCandidateTimes(duration)
+	best, bestScore := times[0], -1.0
+	for _, t := range times {
+		img, err := extractSampleFrame(videoPath, t)
+		if err != nil {
+			log.Printf("Poster candidate at %.2fs failed for %s: %v", t, videoPath, err)
+			continue
+		}
+		if score := frameScore(img); score > bestScore {
+			best, bestScore = t, score
+		}
+	}
+	return best
+}
+
+func extractSampleFrame(videoPath string, t float64) (image.Image, error) {
+	cmd := exec.Command("ffmpeg",
+		"-ss", fmt.Sprintf("%.2f", t),
+		"-i", videoPath,
+		"-vframes", "1",
+		"-vf", "scale=320:-2",
+		"-f", "image2pipe",
+		"-vcodec", "png",
+		"-",
+	)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w", err)
+	}
+	return png.Decode(bytes.NewReader(output))
+}
+
+// frameScore rates a frame by contrast and sharpness, heavily penalising
+// near-black or blown-out frames such as fades and flashes.
+func frameScore(img image.Image) float64 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w < 3 || h < 3 {
+		return 0
+	}
+
+	luma := make([]float64, w*h)
+	var sum float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			l := (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)) / 257
+			luma[y*w+x] = l
+			sum += l
+		}
+	}
+	mean := sum / float64(len(luma))
+
+	var variance, laplacian float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			d := luma[y*w+x] - mean
+			variance += d * d
+			if x > 0 && y > 0 && x < w-1 && y < h-1 {
+				i := y*w + x
+				laplacian += math.Abs(4*luma[i] - luma[i-1] - luma[i+1] - luma[i-w] - luma[i+w])
+			}
+		}
+	}
+	contrast := math.Sqrt(variance / float64(len(luma)))
+	sharpness := laplacian / float64((w-2)*(h-2))
+
+	score := contrast * (1 + sharpness)
+	if mean < 24 || mean > 232 {
+		score *= 0.1
+	}
+	return score
+}
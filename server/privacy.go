@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// APIClient is an additional API key with its own access settings.
+type APIClient struct {
+	Name           string `json:"name"`
+	Key            string `json:"key"`
+	RedactLocation bool   `json:"redact_location"`
+	Write          bool   `json:"write"`
+}
+
+// HomeZone is a sensitive area. Coordinates inside it are never returned
+// as recorded.
+type HomeZone struct {
+	Name      string  `json:"name"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	RadiusM   float64 `json:"radius_m"`
+}
+
+// isMetadataKind reports whether kind can be listed in rendition_metadata.
+// "all" keeps everything, as renditions did before metadata was stripped,
+// and "none" strips everything including colour profiles.
+func isMetadataKind(kind string) bool {
+	switch kind {
+	case "all", "none", "icc", "exif", "xmp", "iptc":
+		return true
+	}
+	return false
+}
+
+// metadataArgs returns the convert options that drop metadata not listed
+// in keep. They must follow -auto-orient, which reads the EXIF orientation.
+func metadataArgs(keep []string) []string {
+	if slices.Contains(keep, "all") {
+		return nil
+	}
+	if len(keep) == 0 || slices.Contains(keep, "none") {
+		return []string{"-strip"}
+	}
+	return []string{"+profile", "!" + strings.Join(keep, ",!") + ",*"}
+}
+
+// ffmpegMetadataArgs drops container metadata, including recorded GPS
+// positions, from generated video unless everything is kept.
+func (c *Config) ffmpegMetadataArgs() []string {
+	if slices.Contains(c.RenditionMetadata, "all") {
+		return nil
+	}
+	return []string{"-map_metadata", "-1"}
+}
+
+type apiClientKey struct{}
+
+func withAPIClient(r *http.Request, client *APIClient) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiClientKey{}, client))
+}
+
+// apiClient returns the client that authenticated the request, or nil when
+// the server has no keys configured.
+func apiClient(r *http.Request) *APIClient {
+	client, _ := r.Context().Value(apiClientKey{}).(*APIClient)
+	return client
+}
+
+func redactsLocation(r *http.Request) bool {
+	client := apiClient(r)
+	return client != nil && client.RedactLocation
+}
+
+func (z *HomeZone) contains(lat, lon float64) bool {
+	return haversineKm(lat, lon, z.Latitude, z.Longitude)*1000 <= z.RadiusM
+}
+
+// fuzzedPoint is a fixed point between one and two radii from the zone
+// centre. Every item in the zone reports the same point, so averaging many
+// of them cannot recover the centre.
+func (z *HomeZone) fuzzedPoint() (lat, lon float64) {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s/%f/%f", z.Name, z.Latitude, z.Longitude)
+	sum := h.Sum64()
+
+	bearing := float64(sum%360) * math.Pi / 180
+	dist := z.RadiusM * (1 + float64((sum>>32)%1000)/1000)
+	lat = z.Latitude + dist*math.Cos(bearing)/111320
+	lon = z.Longitude + dist*math.Sin(bearing)/(111320*math.Cos(z.Latitude*math.Pi/180))
+	return lat, lon
+}
+
+// homeZone returns the zone containing the coordinates, if any.
+func (c *Config) homeZone(lat, lon float64) (*HomeZone, bool) {
+	for i := range c.HomeZones {
+		if c.HomeZones[i].contains(lat, lon) {
+			return &c.HomeZones[i], true
+		}
+	}
+	return nil, false
+}
+
+// applyPrivacy fuzzes coordinates inside home zones and removes location
+// fields entirely for clients that redact them.
+func (h *Handler) applyPrivacy(r *http.Request, photos ...*Photo) {
+	redact := redactsLocation(r)
+	for _, p := range photos {
+		if redact {
+			p.Latitude, p.Longitude, p.Altitude = nil, nil, nil
+			p.Country, p.Region, p.City = "", "", ""
+			continue
+		}
+		if p.Latitude == nil || p.Longitude == nil {
+			continue
+		}
+		if z, ok := h.cfg.homeZone(*p.Latitude, *p.Longitude); ok {
+			lat, lon := z.fuzzedPoint()
+			p.Latitude, p.Longitude, p.Altitude = &lat, &lon, nil
+		}
+	}
+}
+
+// bounds is a box around the zone, for narrowing queries before the exact
+// distance check.
+func (z *HomeZone) bounds() *BBox {
+	dLat := z.RadiusM / 111320
+	dLon := z.RadiusM / (111320 * math.Max(math.Cos(z.Latitude*math.Pi/180), 0.01))
+	return &BBox{
+		MinLat: math.Max(z.Latitude-dLat, -90), MaxLat: math.Min(z.Latitude+dLat, 90),
+		MinLon: z.Longitude - dLon, MaxLon: z.Longitude + dLon,
+	}
+}
+
+// mapClusters clusters the items in bbox with every item inside a home zone
+// counted at the zone's fuzzed point. Those items are taken out of the
+// query and placed before the bbox filter and averaging, so neither a small
+// bbox nor a cluster's centre reveals where they really are.
+func (h *Handler) mapClusters(bbox *BBox, precision int) ([]*MapCluster, error) {
+	var boxes []*BBox
+	for i := range h.cfg.HomeZones {
+		boxes = append(boxes, h.cfg.HomeZones[i].bounds())
+	}
+	clusters, err := h.db.MapClusters(bbox, precision, boxes)
+	if err != nil || len(boxes) == 0 {
+		return clusters, err
+	}
+
+	cells := make(map[string]*MapCluster, len(clusters))
+	for _, c := range clusters {
+		cells[c.Geohash] = c
+	}
+	seen := make(map[int64]bool)
+	for _, box := range boxes {
+		points, err := h.db.GeotaggedIn(box)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range points {
+			if seen[p.PhotoID] {
+				continue
+			}
+			seen[p.PhotoID] = true
+			// Items in the box but outside every zone keep their position
+			if z, ok := h.cfg.homeZone(p.Latitude, p.Longitude); ok {
+				p.Latitude, p.Longitude = z.fuzzedPoint()
+			}
+			if !bbox.contains(p.Latitude, p.Longitude) {
+				continue
+			}
+			cell := encodeGeohash(p.Latitude, p.Longitude, precision)
+			c, ok := cells[cell]
+			if !ok {
+				c = &MapCluster{Geohash: cell, PhotoID: p.PhotoID}
+				cells[cell] = c
+				clusters = append(clusters, c)
+			}
+			n := float64(c.Count)
+			c.Latitude = (c.Latitude*n + p.Latitude) / (n + 1)
+			c.Longitude = (c.Longitude*n + p.Longitude) / (n + 1)
+			c.Count++
+		}
+	}
+	slices.SortStableFunc(clusters, func(a, b *MapCluster) int { return b.Count - a.Count })
+	return clusters, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rendition is a named thumbnail size generated by the scanner. Each
+// rendition is stored in its own subtree under ThumbnailsPath.
+type Rendition struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+}
+
+func DefaultRenditions() []Rendition {
+	return []Rendition{
+		{Name: "grid", Size: 320},
+		{Name: "thumb", Size: 800},
+		{Name: "preview", Size: 2560},
+	}
+}
+
+func (c *Config) Rendition(name string) (Rendition, bool) {
+	if name == "" {
+		name = c.DefaultRendition
+	}
+	for _, r := range c.Renditions {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Rendition{}, false
+}
+
+// RenditionsBySize returns the configured renditions ordered largest first,
+// so smaller sizes can be derived from the previous output instead of the
+// original.
+func (c *Config) RenditionsBySize() []Rendition {
+	sorted := make([]Rendition, len(c.Renditions))
+	copy(sorted, c.Renditions)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Size > sorted[j].Size
+	})
+	return sorted
+}
+
+// RenditionSignature identifies the current rendition configuration. It is
+// stored per photo so a scan regenerates thumbnails when sizes, formats or
+// quality change.
+func (c *Config) RenditionSignature() string {
+	parts := make([]string, 0, len(c.Renditions))
+	for _, r := range c.RenditionsBySize() {
+		parts = append(parts, r.Name+":"+strconv.Itoa(r.Size))
+	}
+	return strings.Join(parts, ",") + ";" + strings.Join(c.ThumbnailFormats, ",") + ";q" + strconv.Itoa(c.ThumbnailQuality) +
+		";m" + strings.Join(c.RenditionMetadata, ",")
+}
+
+// PrimaryFormat is the first configured thumbnail format. It is always
+// generated and served when the client accepts none of the others.
+func (c *Config) PrimaryFormat() string {
+	return c.ThumbnailFormats[0]
+}
+
+// renditionName keeps rendition directories plain names that cannot climb
+// out of ThumbnailsPath or shadow the hidden cache directories.
+var renditionName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// generatedPaths are the paths under ThumbnailsPath that are not
+// renditions, which rendition names must not collide with.
+func (c *Config) generatedPaths() []string {
+	return []string{c.DatabasePath, c.BackupPath, c.ImageCachePath, c.HLSCachePath, c.UploadTempPath}
+}
+
+// pathWithin reports whether path is dir or below it.
+func pathWithin(path, dir string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	return err == nil && (rel == "." || filepath.IsLocal(rel))
+}
+
+// validateRenditions checks rendition names and sizes.
+func (c *Config) validateRenditions() error {
+	seen := make(map[string]bool)
+	for _, r := range c.Renditions {
+		if !renditionName.MatchString(r.Name) || r.Size <= 0 {
+			return fmt.Errorf("invalid rendition %q: name must be letters, digits, - or _ and size must be positive", r.Name)
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("rendition %q is configured twice", r.Name)
+		}
+		seen[r.Name] = true
+		dir := filepath.Join(c.ThumbnailsPath, r.Name)
+		for _, p := range c.generatedPaths() {
+			if p == dir || strings.HasPrefix(p, dir+string(filepath.Separator)) {
+				return fmt.Errorf("rendition %q would share its directory with %s", r.Name, p)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) RenditionPath(originalPath, name, format string) (string, error) {
+	relPath, err := filepath.Rel(c.OriginalsPath, originalPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to get relative path: %w", err)
+	}
+	thumbRelPath := strings.TrimSuffix(relPath, filepath.Ext(relPath)) + "." + formatExtension(format)
+	return filepath.Join(c.ThumbnailsPath, name, thumbRelPath), nil
+}
+
+// writeRenditions resizes src into every configured rendition and format,
+// largest first, deriving each smaller size from the previous primary
+// format output. paths holds the primary format path of each rendition.
+func (c *Config) writeRenditions(src string, paths map[string]string) error {
+	prev := src
+	for i, r := range c.RenditionsBySize() {
+		dst := paths[r.Name]
+		for _, format := range c.ThumbnailFormats {
+			out := strings.TrimSuffix(dst, filepath.Ext(dst)) + "." + formatExtension(format)
+			args := []string{prev,
+				"-resize", fmt.Sprintf("%dx%d>", r.Size, r.Size),
+				"-quality", strconv.Itoa(c.ThumbnailQuality),
+			}
+			if i == 0 {
+				args = append(args, "-auto-orient")
+			}
+			args = append(args, metadataArgs(c.RenditionMetadata)...)
+			args = append(args, format+":"+out)
+			if output, err := exec.Command("convert", args...).CombinedOutput(); err != nil {
+				return fmt.Errorf("convert failed for %s %s: %w: %s", r.Name, format, err, output)
+			}
+		}
+		prev = dst
+	}
+	return nil
+}
+
+func isImageFormat(format string) bool {
+	switch format {
+	case "jpeg", "png", "webp", "avif":
+		return true
+	}
+	return false
+}
+
+func formatExtension(format string) string {
+	if format == "jpeg" {
+		return "jpg"
+	}
+	return format
+}
+
+func formatFromPath(path string) string {
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	if ext == "jpg" {
+		return "jpeg"
+	}
+	return ext
+}
+
+func imageContentType(format string) string {
+	switch format {
+	case "png":
+		return "image/png"
+	case "webp":
+		return "image/webp"
+	case "avif":
+		return "image/avif"
+	default:
+		return "image/jpeg"
+	}
+}
+
+// negotiateImageFormat picks the most compact of the available formats that
+// the Accept header names explicitly. Wildcards only ever select JPEG, since
+// clients sending "*/*" cannot be assumed to decode WebP or AVIF. When nothing
+// else fits the first available format is returned.
+func negotiateImageFormat(accept string, available []string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		rejected := false
+		for _, param := range fields[1:] {
+			if q, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+					rejected = true
+				}
+			}
+		}
+		if !rejected {
+			accepted[mediaType] = true
+		}
+	}
+
+	for _, format := range []string{"avif", "webp"} {
+		if slices.Contains(available, format) && accepted[imageContentType(format)] {
+			return format
+		}
+	}
+	if slices.Contains(available, "jpeg") {
+		return "jpeg"
+	}
+	return available[0]
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestNegotiateImageFormat(t *testing.T) {
+	all := []string{"jpeg", "webp", "avif"}
+	tests := []struct {
+		name      string
+		accept    string
+		available []string
+		want      string
+	}{
+		{"no header", "", all, "jpeg"},
+		{"wildcard", "*/*", all, "jpeg"},
+		{"image wildcard", "image/*", all, "jpeg"},
+		{"webp", "image/webp,*/*", all, "webp"},
+		{"avif preferred", "image/avif,image/webp,*/*;q=0.8", all, "avif"},
+		{"avif unavailable", "image/avif,image/webp", []string{"jpeg", "webp"}, "webp"},
+		{"avif rejected", "image/avif;q=0,image/webp", all, "webp"},
+		{"case and spaces", " Image/WebP ; q=0.9 , */*", all, "webp"},
+		{"jpeg unavailable", "*/*", []string{"webp", "avif"}, "webp"},
+		{"jpeg only", "image/avif,image/webp", []string{"jpeg"}, "jpeg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := negotiateImageFormat(tt.accept, tt.available); got != tt.want {
+				t.Errorf("negotiateImageFormat(%q, %v) = %q, want %q", tt.accept, tt.available, got, tt.want)
+			}
+		})
+	}
+}
@@ -5,22 +5,42 @@ import (
 	"fmt"
 	"io/fs"
 	"log"
+	"maps"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type Scanner struct {
 	cfg      *Config
 	db       *Database
+	thumbs   *ThumbnailCache
+	geocoder *Geocoder
 	scanning atomic.Bool
+
+	// mu keeps file operations from running during a scan, which would
+	// otherwise index moved files a second time
+	mu sync.Mutex
+
+	// placing serialises adding new files, so two copies of the same
+	// content cannot both pass the duplicate check. queued holds the
+	// content hashes of added files waiting for mu, by path.
+	placing sync.Mutex
+	queueMu sync.Mutex
+	queued  map[string]string
+
+	cleanupAlert atomic.Pointer[string]
 }
 
-func NewScanner(cfg *Config, db *Database) *Scanner {
-	return &Scanner{cfg: cfg, db: db}
+func NewScanner(cfg *Config, db *Database, thumbs *ThumbnailCache, geocoder *Geocoder) *Scanner {
+	return &Scanner{cfg: cfg, db: db, thumbs: thumbs, geocoder: geocoder, queued: make(map[string]string)}
 }
 
 func (s *Scanner) IsScanning() bool {
@@ -43,21 +63,37 @@ func (s *Scanner) TryScan() bool {
 }
 
 func (s *Scanner) Scan() error {
+	return s.ScanPath("", false)
+}
+
+// ScanPath scans the subdirectory sub of the originals, or all of them when
+// sub is empty. force reprocesses files that are already up to date.
+func (s *Scanner) ScanPath(sub string, force bool) error {
+	if sub != "" && !filepath.IsLocal(sub) {
+		return fmt.Errorf("path %q is outside the originals directory", sub)
+	}
+
 	// Ensure thumbnails directory exists
 	if err := os.MkdirAll(s.cfg.ThumbnailsPath, 0755); err != nil {
 		return fmt.Errorf("failed to create thumbnails directory: %w", err)
 	}
 
-	s.cleanup()
+	s.mu.Lock()
+	defer s.unlock()
+
+	s.cleanup(false)
 
 	// Walk the originals directory
-	err := filepath.WalkDir(s.cfg.OriginalsPath, func(path string, d fs.DirEntry, err error) error {
+	err := filepath.WalkDir(filepath.Join(s.cfg.OriginalsPath, sub), func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			log.Printf("Error accessing %s: %v", path, err)
 			return nil // Continue despite errors
 		}
 
 		if d.IsDir() {
+			if path == s.trashDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
@@ -81,51 +117,477 @@ func (s *Scanner) Scan() error {
 			return nil
 		}
 
-		exists, err := s.db.PhotoExists(path, info.ModTime())
+		exists, err := s.db.PhotoExists(path, info.ModTime(), s.cfg.RenditionSignature())
 		if err != nil {
 			log.Printf("Error checking existence for %s: %v", path, err)
 			return nil
 		}
-		if exists {
+		if exists && !force {
 			return nil
 		}
 
-		if s.isVideoExtension(ext) {
-			if err := s.processVideo(path, info); err != nil {
-				log.Printf("Error processing video %s: %v", path, err)
+		s.process(path, info)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.backfillPlaceholders()
+	s.backfillVideoMetadata()
+	s.backfillLocations()
+	s.backfillPlaces()
+	s.backfillVideoPreviews()
+	return nil
+}
+
+func (s *Scanner) process(path string, info fs.FileInfo) {
+	s.reclaimPath(path)
+	if s.isVideoExtension(strings.ToLower(filepath.Ext(path))) {
+		if err := s.processVideo(path, info); err != nil {
+			log.Printf("Error processing video %s: %v", path, err)
+		}
+	} else if err := s.processPhoto(path, info); err != nil {
+		log.Printf("Error processing %s: %v", path, err)
+	}
+}
+
+// Place adds a new file, such as an upload, to the library. tmp is the
+// complete file under a hidden name in dest's folder; it is moved to dest,
+// or to a free " (n)" name beside it, and indexed with its content hash.
+// When the library already has the content tmp is removed and the copy
+// that is there returned as a duplicate. Photo is nil when the file waits
+// for a scan to finish before it is indexed. On error tmp is left for the
+// caller to retry or remove.
+func (s *Scanner) Place(tmp, dest string, size int64, hash string) (*UploadResult, error) {
+	s.placing.Lock()
+	defer s.placing.Unlock()
+
+	if path := s.queuedCopy(hash); path != "" {
+		os.Remove(tmp)
+		return &UploadResult{Path: path, Duplicate: true}, nil
+	}
+	dup, err := s.FindDuplicate(size, hash)
+	if err != nil {
+		return nil, err
+	}
+	if dup != nil {
+		os.Remove(tmp)
+		return &UploadResult{Path: dup.OriginalPath, Photo: dup, Duplicate: true}, nil
+	}
+
+	path, err := claimPath(tmp, dest)
+	if err != nil {
+		return nil, err
+	}
+	// The file is safely stored even if it cannot be indexed yet
+	photo, err := s.ingest(path, hash)
+	if err != nil {
+		log.Printf("Error indexing %s: %v", path, err)
+	}
+	return &UploadResult{Path: path, Photo: photo}, nil
+}
+
+// queuedCopy returns a queued file with the given content hash, or "".
+func (s *Scanner) queuedCopy(hash string) string {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	for path, h := range s.queued {
+		if h == hash {
+			return path
+		}
+	}
+	return ""
+}
+
+// ingest indexes a newly added file straight away. While a scan or file
+// operation holds mu the file is queued and nil is returned; it is indexed
+// when mu is released.
+func (s *Scanner) ingest(path, hash string) (*Photo, error) {
+	if !s.mu.TryLock() {
+		s.queueMu.Lock()
+		s.queued[path] = hash
+		s.queueMu.Unlock()
+		// The holder may have let go before the file was queued
+		if s.mu.TryLock() {
+			s.unlock()
+		}
+		return nil, nil
+	}
+	defer s.unlock()
+	return s.index(path, hash)
+}
+
+// unlock releases mu after indexing the files queued while it was held.
+// Files stay queued until they are indexed so Place still finds them. One
+// queued after the last look is indexed here if mu is free again, or else
+// by whoever holds it.
+func (s *Scanner) unlock() {
+	for {
+		s.queueMu.Lock()
+		queued := maps.Clone(s.queued)
+		s.queueMu.Unlock()
+		for path, hash := range queued {
+			if _, err := s.index(path, hash); err != nil {
+				log.Printf("Error indexing %s: %v", path, err)
 			}
-		} else if err := s.processPhoto(path, info); err != nil {
-			log.Printf("Error processing %s: %v", path, err)
+			s.queueMu.Lock()
+			delete(s.queued, path)
+			s.queueMu.Unlock()
 		}
+		s.mu.Unlock()
 
-		return nil
-	})
+		s.queueMu.Lock()
+		empty := len(s.queued) == 0
+		s.queueMu.Unlock()
+		if empty || !s.mu.TryLock() {
+			return
+		}
+	}
+}
+
+// index processes a file added outside a scan and records its content
+// hash. The caller holds mu.
+func (s *Scanner) index(path, hash string) (*Photo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	s.process(path, info)
+	p, err := s.db.GetPhotoByPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s was not indexed: %w", path, err)
+	}
+	if err := s.db.SetContentHash(p.ID, hash); err != nil {
+		return nil, err
+	}
+	p.ContentHash = hash
+	return p, nil
+}
+
+// captureInfo reads the capture time and camera of a file that has not been
+// indexed yet. name is the name the file will have, since path may be a
+// temporary file.
+func (s *Scanner) captureInfo(path, name string) *photoMetadata {
+	if s.isVideoExtension(strings.ToLower(filepath.Ext(name))) {
+		v := s.probeVideo(path)
+		return &photoMetadata{CapturedAt: v.CapturedAt, CameraMake: v.CameraMake, CameraModel: v.CameraModel}
+	}
+	meta, err := readPhotoMetadata(path)
+	if err != nil {
+		log.Printf("Error reading metadata for %s: %v", path, err)
+		return &photoMetadata{}
+	}
+	return meta
+}
+
+// Rebuild regenerates thumbnails and metadata for every indexed item in
+// folder and its subfolders, or the whole library when folder is empty.
+// It returns the number of items processed.
+func (s *Scanner) Rebuild(folder string) (int, error) {
+	photos, err := s.db.ListPhotos(PhotoFilter{Folder: folder}, -1, 0)
+	if err != nil {
+		return 0, err
+	}
+	processed := 0
+	for _, p := range photos {
+		info, err := os.Stat(p.OriginalPath)
+		if err != nil {
+			log.Printf("Skipping %s: %v", p.OriginalPath, err)
+			continue
+		}
+		s.process(p.OriginalPath, info)
+		processed++
+	}
+	return processed, nil
+}
+
+// backfillPlaceholders computes placeholders for photos indexed before they
+// were introduced, without regenerating their thumbnails.
+func (s *Scanner) backfillPlaceholders() {
+	photos, err := s.db.PhotosMissingPlaceholder()
+	if err != nil {
+		log.Printf("Error fetching photos for placeholder backfill: %v", err)
+		return
+	}
+
+	for _, p := range photos {
+		thumbPath, err := s.cfg.RenditionPath(p.OriginalPath, s.smallestRendition().Name, s.cfg.PrimaryFormat())
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(thumbPath); err != nil {
+			thumbPath = p.ThumbnailPath
+		}
+		hash, aspect, err := generatePlaceholder(thumbPath)
+		if err != nil {
+			log.Printf("Error generating placeholder for %s: %v", p.OriginalPath, err)
+			continue
+		}
+		if err := s.db.SetPlaceholder(p.ID, hash, aspect); err != nil {
+			log.Printf("Error saving placeholder for %s: %v", p.OriginalPath, err)
+		}
+	}
+}
+
+// backfillVideoMetadata re-probes videos indexed before the full metadata
+// was recorded. Thumbnails are left untouched. A video is marked read once
+// ffprobe finds its video stream, whether or not it reports a bitrate.
+func (s *Scanner) backfillVideoMetadata() {
+	videos, err := s.db.VideosMissingMetadata()
+	if err != nil {
+		log.Printf("Error fetching videos for metadata backfill: %v", err)
+		return
+	}
+
+	for _, v := range videos {
+		meta := s.probeVideo(v.OriginalPath)
+		if meta.VideoCodec == "" {
+			continue
+		}
+		v.Width, v.Height = meta.Width, meta.Height
+		v.Rotation = meta.Rotation
+		v.ColorTransfer = meta.ColorTransfer
+		v.HDRFormat = meta.HDRFormat
+		v.Bitrate = meta.Bitrate
+		v.CapturedAt = meta.CapturedAt
+		v.Latitude, v.Longitude, v.Altitude = meta.Latitude, meta.Longitude, meta.Altitude
+		v.CameraMake, v.CameraModel = meta.CameraMake, meta.CameraModel
+		v.AudioChannels = meta.AudioChannels
+		v.MetadataRead = true
+		s.geocoder.Annotate(v)
+		if err := s.db.UpsertPhoto(v); err != nil {
+			log.Printf("Error saving metadata for %s: %v", v.OriginalPath, err)
+		}
+	}
+}
+
+// backfillLocations reads EXIF for photos indexed before capture time and
+// GPS were recorded, and stores geohashes for rows that lack one.
+func (s *Scanner) backfillLocations() {
+	photos, err := s.db.PhotosMissingLocation()
+	if err != nil {
+		log.Printf("Error fetching photos for location backfill: %v", err)
+		return
+	}
+
+	_, lookErr := exec.LookPath("exiftool")
+	if lookErr != nil && len(photos) > 0 {
+		log.Printf("exiftool not found, skipping EXIF for existing photos")
+	}
+
+	for _, p := range photos {
+		if p.MediaType == "photo" && !p.MetadataRead {
+			if lookErr != nil {
+				continue
+			}
+			meta, err := readPhotoMetadata(p.OriginalPath)
+			if err != nil {
+				log.Printf("Error reading metadata for %s: %v", p.OriginalPath, err)
+				continue
+			}
+			applyPhotoMetadata(p, meta)
+		}
+		s.geocoder.Annotate(p)
+		if err := s.db.UpsertPhoto(p); err != nil {
+			log.Printf("Error saving location for %s: %v", p.OriginalPath, err)
+		}
+	}
+}
+
+// backfillPlaces names the location of geotagged items indexed before a
+// gazetteer was configured.
+func (s *Scanner) backfillPlaces() {
+	if s.geocoder == nil {
+		return
+	}
+	photos, err := s.db.PhotosMissingPlace()
+	if err != nil {
+		log.Printf("Error fetching photos for place backfill: %v", err)
+		return
+	}
+
+	for _, p := range photos {
+		s.geocoder.Annotate(p)
+		if p.Country == "" {
+			continue
+		}
+		if err := s.db.UpsertPhoto(p); err != nil {
+			log.Printf("Error saving place for %s: %v", p.OriginalPath, err)
+		}
+	}
+}
 
-	return err
+func applyPhotoMetadata(p *Photo, meta *photoMetadata) {
+	p.CapturedAt = meta.CapturedAt
+	p.Latitude, p.Longitude, p.Altitude = meta.Latitude, meta.Longitude, meta.Altitude
+	p.CameraMake, p.CameraModel = meta.CameraMake, meta.CameraModel
+	p.MetadataRead = true
 }
 
-func (s *Scanner) cleanup() {
+func (s *Scanner) smallestRendition() Rendition {
+	renditions := s.cfg.RenditionsBySize()
+	return renditions[len(renditions)-1]
+}
+
+// placeholder computes the ThumbHash and aspect ratio from the smallest
+// rendition. Failures are logged rather than failing the photo, since
+// placeholders are optional.
+func (s *Scanner) placeholder(originalPath string, thumbPaths map[string]string) (string, float64) {
+	hash, aspect, err := generatePlaceholder(thumbPaths[s.smallestRendition().Name])
+	if err != nil {
+		log.Printf("Error generating placeholder for %s: %v", originalPath, err)
+	}
+	return hash, aspect
+}
+
+// cleanup moves rows whose originals have gone to the trash and purges
+// trashed rows older than PurgeAfter. Rows whose files come back are
+// restored.
+// Nothing is marked when the originals look unmounted, or when more than
+// CleanupMaxFraction of the library vanished at once unless force is set.
+func (s *Scanner) cleanup(force bool) {
+	if err := s.checkOriginals(); err != nil {
+		s.setCleanupAlert(fmt.Sprintf("Cleanup skipped: %v", err))
+		return
+	}
+
 	paths, err := s.db.AllOriginalPaths()
 	if err != nil {
 		log.Printf("Error fetching paths for cleanup: %v", err)
 		return
 	}
 
-	removed := 0
+	var gone []string
+	var returned []IndexedPath
+	live := 0
 	for _, p := range paths {
-		if _, err := os.Stat(p.OriginalPath); os.IsNotExist(err) {
-			if err := s.db.DeletePhoto(p.OriginalPath); err != nil {
-				log.Printf("Error removing db entry for %s: %v", p.OriginalPath, err)
-				continue
+		if p.DeletedAt == nil {
+			live++
+		}
+		_, err := os.Stat(p.OriginalPath)
+		switch {
+		case os.IsNotExist(err) && p.DeletedAt == nil:
+			gone = append(gone, p.OriginalPath)
+		case err == nil && p.DeletedAt != nil:
+			returned = append(returned, p)
+		}
+	}
+
+	if !force && s.tooManyMissing(len(gone), live) {
+		s.setCleanupAlert(fmt.Sprintf("Cleanup aborted: %d of %d originals are missing, more than cleanup_max_fraction %g; run prune -force if they were deleted on purpose", len(gone), live, s.cfg.CleanupMaxFraction))
+		return
+	}
+	s.setCleanupAlert("")
+
+	now := time.Now()
+	for _, path := range gone {
+		if err := s.db.SetDeleted(path, &now, ""); err != nil {
+			log.Printf("Error marking %s deleted: %v", path, err)
+		}
+	}
+	for _, p := range returned {
+		s.reclaimPath(p.OriginalPath)
+	}
+
+	expired, err := s.db.DeletedBefore(now.Add(-s.cfg.PurgeAfter))
+	if err != nil {
+		log.Printf("Error fetching deleted entries: %v", err)
+		return
+	}
+	purged := 0
+	for _, p := range expired {
+		if err := s.db.DeletePhoto(p.OriginalPath); err != nil {
+			log.Printf("Error removing db entry for %s: %v", p.OriginalPath, err)
+			continue
+		}
+		s.removeThumbnails(p.OriginalPath, p.ThumbnailPath)
+		s.purgeTrashed(p.TrashPath)
+		purged++
+	}
+
+	if len(gone) > 0 || len(returned) > 0 || purged > 0 {
+		log.Printf("Cleanup: %d missing, %d returned, %d purged", len(gone), len(returned), purged)
+	}
+}
+
+// tooManyMissing reports whether marking missing of live items at once
+// exceeds cleanup_max_fraction. A single missing item is always allowed, so
+// small libraries can still clean up.
+func (s *Scanner) tooManyMissing(missing, live int) bool {
+	return missing > 1 && float64(missing) > s.cfg.CleanupMaxFraction*float64(live)
+}
+
+// checkOriginals guards against an unmounted originals volume, which would
+// otherwise look as if every file had been deleted.
+func (s *Scanner) checkOriginals() error {
+	if s.cfg.OriginalsSentinel != "" {
+		sentinel := filepath.Join(s.cfg.OriginalsPath, s.cfg.OriginalsSentinel)
+		if _, err := os.Stat(sentinel); err != nil {
+			return fmt.Errorf("sentinel %s not found; is the originals volume mounted?", sentinel)
+		}
+		return nil
+	}
+
+	dir, err := os.Open(s.cfg.OriginalsPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if names, _ := dir.Readdirnames(1); len(names) == 0 {
+		return fmt.Errorf("%s is empty; is the originals volume mounted?", s.cfg.OriginalsPath)
+	}
+	return nil
+}
+
+// CleanupAlert returns why the last cleanup did not run, or "".
+func (s *Scanner) CleanupAlert() string {
+	if msg := s.cleanupAlert.Load(); msg != nil {
+		return *msg
+	}
+	return ""
+}
+
+func (s *Scanner) setCleanupAlert(msg string) {
+	if msg != "" {
+		log.Printf("ALERT: %s", msg)
+	}
+	s.cleanupAlert.Store(&msg)
+}
+
+func (s *Scanner) removeThumbnails(originalPath, thumbnailPath string) {
+	s.thumbs.Invalidate(originalPath)
+	os.Remove(thumbnailPath)
+	for _, kind := range videoAssetKinds() {
+		if p, err := s.cfg.VideoAssetPath(originalPath, kind); err == nil {
+			os.Remove(p)
+		}
+	}
+	for _, r := range s.cfg.Renditions {
+		for _, format := range s.cfg.ThumbnailFormats {
+			if p, err := s.cfg.RenditionPath(originalPath, r.Name, format); err == nil {
+				os.Remove(p)
 			}
-			os.Remove(p.ThumbnailPath)
-			removed++
 		}
 	}
+}
 
-	if removed > 0 {
-		log.Printf("Cleanup: removed %d orphaned entries", removed)
+// renditionPaths returns the primary format thumbnail path of every
+// configured rendition for an original, creating the per-rendition
+// directories as needed.
+func (s *Scanner) renditionPaths(originalPath string) (map[string]string, error) {
+	paths := make(map[string]string, len(s.cfg.Renditions))
+	for _, r := range s.cfg.Renditions {
+		p, err := s.cfg.RenditionPath(originalPath, r.Name, s.cfg.PrimaryFormat())
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create thumbnail directory: %w", err)
+		}
+		paths[r.Name] = p
 	}
+	return paths, nil
 }
 
 func (s *Scanner) isSupportedExtension(ext string) bool {
@@ -176,30 +638,33 @@ func isStandardImage(ext string) bool {
 func (s *Scanner) processPhoto(path string, info fs.FileInfo) error {
 	log.Printf("Processing: %s", path)
 
-	// Calculate thumbnail path (mirror directory structure)
 	relPath, err := filepath.Rel(s.cfg.OriginalsPath, path)
 	if err != nil {
 		return fmt.Errorf("failed to get relative path: %w", err)
 	}
 
-	// Change extension to .jpg for thumbnail
-	thumbRelPath := strings.TrimSuffix(relPath, filepath.Ext(relPath)) + ".jpg"
-	thumbPath := filepath.Join(s.cfg.ThumbnailsPath, thumbRelPath)
-
-	// Create thumbnail directory if needed
-	thumbDir := filepath.Dir(thumbPath)
-	if err := os.MkdirAll(thumbDir, 0755); err != nil {
-		return fmt.Errorf("failed to create thumbnail directory: %w", err)
+	// Thumbnail paths mirror the directory structure under each rendition
+	thumbPaths, err := s.renditionPaths(path)
+	if err != nil {
+		return err
 	}
 
-	// Generate thumbnail using dcraw + ImageMagick
+	// Generate thumbnails using dcraw + ImageMagick
 	// dcraw extracts embedded JPEG preview or converts RAW
-	// convert resizes to thumbnail size
-	width, height, err := s.generateThumbnail(path, thumbPath)
+	// convert resizes to each rendition size
+	width, height, err := s.generateThumbnail(path, thumbPaths)
 	if err != nil {
 		return fmt.Errorf("failed to generate thumbnail: %w", err)
 	}
 
+	thumbHash, aspectRatio := s.placeholder(path, thumbPaths)
+
+	// Metadata is optional; backfillLocations retries failures
+	meta, err := readPhotoMetadata(path)
+	if err != nil {
+		log.Printf("Error reading metadata for %s: %v", path, err)
+	}
+
 	// Calculate folder (relative to originals)
 	folder := filepath.Dir(relPath)
 	if folder == "." {
@@ -208,7 +673,7 @@ func (s *Scanner) processPhoto(path string, info fs.FileInfo) error {
 
 	photo := &Photo{
 		OriginalPath:  path,
-		ThumbnailPath: thumbPath,
+		ThumbnailPath: thumbPaths[s.cfg.DefaultRendition],
 		Folder:        folder,
 		Filename:      info.Name(),
 		Extension:     strings.ToLower(filepath.Ext(path)),
@@ -217,33 +682,34 @@ func (s *Scanner) processPhoto(path string, info fs.FileInfo) error {
 		Width:         width,
 		Height:        height,
 		MediaType:     "photo",
+		Renditions:    s.cfg.RenditionSignature(),
+		ThumbHash:     thumbHash,
+		AspectRatio:   aspectRatio,
+	}
+	if meta != nil {
+		applyPhotoMetadata(photo, meta)
 	}
 
+	s.geocoder.Annotate(photo)
+	s.thumbs.Invalidate(path)
 	return s.db.UpsertPhoto(photo)
 }
 
-func (s *Scanner) generateThumbnail(rawPath, thumbPath string) (width, height int, err error) {
+func (s *Scanner) generateThumbnail(rawPath string, thumbPaths map[string]string) (width, height int, err error) {
 	ext := strings.ToLower(filepath.Ext(rawPath))
 
 	if isStandardImage(ext) {
-		return s.generateStandardThumbnail(rawPath, thumbPath)
+		return s.generateStandardThumbnail(rawPath, thumbPaths)
 	}
-	return s.generateRawThumbnail(rawPath, thumbPath)
+	return s.generateRawThumbnail(rawPath, thumbPaths)
 }
 
-func (s *Scanner) generateStandardThumbnail(imgPath, thumbPath string) (width, height int, err error) {
-	size := fmt.Sprintf("%dx%d>", s.cfg.ThumbnailSize, s.cfg.ThumbnailSize)
-	cmd := exec.Command("convert", imgPath+"[0]",
-		"-resize", size,
-		"-quality", "85",
-		"-auto-orient",
-		thumbPath,
-	)
-	if err := cmd.Run(); err != nil {
-		return 0, 0, fmt.Errorf("convert failed: %w", err)
+func (s *Scanner) generateStandardThumbnail(imgPath string, thumbPaths map[string]string) (width, height int, err error) {
+	if err := s.cfg.writeRenditions(imgPath+"[0]", thumbPaths); err != nil {
+		return 0, 0, err
 	}
 
-	cmd = exec.Command("identify", "-format", "%w %h", imgPath+"[0]")
+	cmd := exec.Command("identify", "-format", "%w %h", imgPath+"[0]")
 	output, err := cmd.Output()
 	if err != nil {
 		return 0, 0, nil
@@ -252,7 +718,7 @@ func (s *Scanner) generateStandardThumbnail(imgPath, thumbPath string) (width, h
 	return width, height, nil
 }
 
-func (s *Scanner) generateRawThumbnail(rawPath, thumbPath string) (width, height int, err error) {
+func (s *Scanner) generateRawThumbnail(rawPath string, thumbPaths map[string]string) (width, height int, err error) {
 	previewPath := rawPath + ".thumb.jpg"
 
 	cmd := exec.Command("dcraw", "-e", "-c", rawPath)
@@ -281,15 +747,8 @@ func (s *Scanner) generateRawThumbnail(rawPath, thumbPath string) (width, height
 	}
 	tempFile.Close()
 
-	size := fmt.Sprintf("%dx%d>", s.cfg.ThumbnailSize, s.cfg.ThumbnailSize)
-	cmd = exec.Command("convert", tempPath,
-		"-resize", size,
-		"-quality", "85",
-		"-auto-orient",
-		thumbPath,
-	)
-	if err := cmd.Run(); err != nil {
-		return 0, 0, fmt.Errorf("convert failed: %w", err)
+	if err := s.cfg.writeRenditions(tempPath, thumbPaths); err != nil {
+		return 0, 0, err
 	}
 
 	cmd = exec.Command("dcraw", "-i", "-v", rawPath)
@@ -307,12 +766,23 @@ func (s *Scanner) generateRawThumbnail(rawPath, thumbPath string) (width, height
 }
 
 type videoMetadata struct {
-	Width      int
-	Height     int
-	Duration   float64
-	VideoCodec string
-	AudioCodec string
-	Framerate  float64
+	Width         int
+	Height        int
+	Duration      float64
+	VideoCodec    string
+	AudioCodec    string
+	Framerate     float64
+	Rotation      int
+	ColorTransfer string
+	HDRFormat     string
+	Bitrate       int64
+	CapturedAt    *time.Time
+	Latitude      *float64
+	Longitude     *float64
+	Altitude      *float64
+	CameraMake    string
+	CameraModel   string
+	AudioChannels int
 }
 
 func (s *Scanner) processVideo(path string, info fs.FileInfo) error {
@@ -323,18 +793,32 @@ func (s *Scanner) processVideo(path string, info fs.FileInfo) error {
 		return fmt.Errorf("failed to get relative path: %w", err)
 	}
 
-	thumbRelPath := strings.TrimSuffix(relPath, filepath.Ext(relPath)) + ".jpg"
-	thumbPath := filepath.Join(s.cfg.ThumbnailsPath, thumbRelPath)
+	thumbPaths, err := s.renditionPaths(path)
+	if err != nil {
+		return err
+	}
 
-	if err := os.MkdirAll(filepath.Dir(thumbPath), 0755); err != nil {
-		return fmt.Errorf("failed to create thumbnail directory: %w", err)
+	// Keep a manually chosen poster frame across rescans
+	var posterTime *float64
+	if existing, err := s.db.GetPhotoByPath(path); err == nil {
+		posterTime = existing.PosterTime
 	}
 
-	meta, err := s.generateVideoThumbnail(path, thumbPath)
+	meta, err := s.generateVideoThumbnail(path, thumbPaths, posterTime)
 	if err != nil {
 		return fmt.Errorf("failed to generate video thumbnail: %w", err)
 	}
 
+	thumbHash, aspectRatio := s.placeholder(path, thumbPaths)
+
+	// Previews are optional; a failure is recorded so that scans do not
+	// retry it until the file changes
+	var previewError string
+	if err := s.generateVideoPreviews(path, meta.Duration, meta.Framerate); err != nil {
+		log.Printf("Error generating video previews for %s: %v", path, err)
+		previewError = err.Error()
+	}
+
 	folder := filepath.Dir(relPath)
 	if folder == "." {
 		folder = ""
@@ -342,7 +826,7 @@ func (s *Scanner) processVideo(path string, info fs.FileInfo) error {
 
 	photo := &Photo{
 		OriginalPath:  path,
-		ThumbnailPath: thumbPath,
+		ThumbnailPath: thumbPaths[s.cfg.DefaultRendition],
 		Folder:        folder,
 		Filename:      info.Name(),
 		Extension:     strings.ToLower(filepath.Ext(path)),
@@ -355,33 +839,87 @@ func (s *Scanner) processVideo(path string, info fs.FileInfo) error {
 		VideoCodec:    meta.VideoCodec,
 		AudioCodec:    meta.AudioCodec,
 		Framerate:     meta.Framerate,
+		Rotation:      meta.Rotation,
+		ColorTransfer: meta.ColorTransfer,
+		HDRFormat:     meta.HDRFormat,
+		Bitrate:       meta.Bitrate,
+		CapturedAt:    meta.CapturedAt,
+		Latitude:      meta.Latitude,
+		Longitude:     meta.Longitude,
+		Altitude:      meta.Altitude,
+		CameraMake:    meta.CameraMake,
+		CameraModel:   meta.CameraModel,
+		AudioChannels: meta.AudioChannels,
+		Renditions:    s.cfg.RenditionSignature(),
+		ThumbHash:     thumbHash,
+		AspectRatio:   aspectRatio,
+		MetadataRead:  true,
 	}
 
-	return s.db.UpsertPhoto(photo)
+	s.geocoder.Annotate(photo)
+	s.thumbs.Invalidate(path)
+	if err := s.db.UpsertPhoto(photo); err != nil {
+		return err
+	}
+	return s.db.SetPreviewError(path, previewError)
 }
 
-func (s *Scanner) generateVideoThumbnail(videoPath, thumbPath string) (*videoMetadata, error) {
+// SetPoster stores the poster frame time of a video, or returns it to
+// automatic selection with nil, and regenerates the video straight away.
+// Like file operations it refuses to run during a scan, which may be
+// writing the same poster and previews.
+func (s *Scanner) SetPoster(p *Photo, t *float64) error {
+	if !s.mu.TryLock() {
+		return errScanRunning
+	}
+	defer s.unlock()
+
+	info, err := os.Stat(p.OriginalPath)
+	if err != nil {
+		return err
+	}
+	if err := s.db.SetPosterTime(p.ID, t); err != nil {
+		return err
+	}
+	return s.processVideo(p.OriginalPath, info)
+}
+
+// generateVideoThumbnail extracts the poster frame at posterTime, or at the
+// best scoring candidate frame when no time has been chosen.
+func (s *Scanner) generateVideoThumbnail(videoPath string, thumbPaths map[string]string, posterTime *float64) (*videoMetadata, error) {
 	meta := s.probeVideo(videoPath)
 
-	seekTime := "1"
-	if meta.Duration > 0 && meta.Duration < 4 {
-		seekTime = fmt.Sprintf("%.2f", meta.Duration*0.25)
+	var seekTime float64
+	if posterTime != nil {
+		seekTime = *posterTime
+	} else {
+		seekTime = selectPosterTime(videoPath, meta.Duration)
 	}
 
-	size := fmt.Sprintf("%d", s.cfg.ThumbnailSize)
+	tempFile, err := os.CreateTemp("", "glimpse-*.jpg")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tempPath := tempFile.Name()
+	tempFile.Close()
+	defer os.Remove(tempPath)
 
 	cmd := exec.Command("ffmpeg",
-		"-ss", seekTime,
+		"-ss", fmt.Sprintf("%.2f", seekTime),
 		"-i", videoPath,
 		"-vframes", "1",
-		"-vf", fmt.Sprintf("scale=%s:%s:force_original_aspect_ratio=decrease", size, size),
+		"-q:v", "2",
 		"-y",
-		thumbPath,
+		tempPath,
 	)
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return nil, fmt.Errorf("ffmpeg thumbnail failed: %w: %s", err, output)
 	}
 
+	if err := s.cfg.writeRenditions(tempPath, thumbPaths); err != nil {
+		return nil, err
+	}
+
 	return meta, nil
 }
 
@@ -400,33 +938,70 @@ func (s *Scanner) probeVideo(videoPath string) *videoMetadata {
 		log.Printf("ffprobe failed for %s: %v", videoPath, err)
 		return meta
 	}
+	parsed, err := parseVideoProbe(output)
+	if err != nil {
+		log.Printf("ffprobe parse failed for %s: %v", videoPath, err)
+		return meta
+	}
+	return parsed
+}
 
+// parseVideoProbe reads ffprobe's JSON output for a video.
+func parseVideoProbe(output []byte) (*videoMetadata, error) {
+	meta := &videoMetadata{}
 	var probe struct {
 		Streams []struct {
-			CodecType  string `json:"codec_type"`
-			CodecName  string `json:"codec_name"`
-			Width      int    `json:"width"`
-			Height     int    `json:"height"`
-			RFrameRate string `json:"r_frame_rate"`
+			CodecType     string            `json:"codec_type"`
+			CodecName     string            `json:"codec_name"`
+			Width         int               `json:"width"`
+			Height        int               `json:"height"`
+			RFrameRate    string            `json:"r_frame_rate"`
+			ColorTransfer string            `json:"color_transfer"`
+			Channels      int               `json:"channels"`
+			Tags          map[string]string `json:"tags"`
+			Disposition   struct {
+				AttachedPic int `json:"attached_pic"`
+			} `json:"disposition"`
+			SideDataList []struct {
+				SideDataType string  `json:"side_data_type"`
+				Rotation     float64 `json:"rotation"`
+			} `json:"side_data_list"`
 		} `json:"streams"`
 		Format struct {
-			Duration string `json:"duration"`
+			Duration string            `json:"duration"`
+			BitRate  string            `json:"bit_rate"`
+			Tags     map[string]string `json:"tags"`
 		} `json:"format"`
 	}
 
 	if err := json.Unmarshal(output, &probe); err != nil {
-		log.Printf("ffprobe parse failed for %s: %v", videoPath, err)
-		return meta
+		return nil, err
 	}
 
 	if dur, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
 		meta.Duration = dur
 	}
+	if rate, err := strconv.ParseInt(probe.Format.BitRate, 10, 64); err == nil {
+		meta.Bitrate = rate
+	}
+
+	tags := probe.Format.Tags
+	if t, err := time.Parse(time.RFC3339Nano, tags["creation_time"]); err == nil {
+		meta.CapturedAt = &t
+	}
+	location := tags["com.apple.quicktime.location.ISO6709"]
+	if location == "" {
+		location = tags["location"]
+	}
+	meta.Latitude, meta.Longitude, meta.Altitude = parseISO6709(location)
+	meta.CameraMake = firstTag(tags, "com.apple.quicktime.make", "make", "com.android.manufacturer")
+	meta.CameraModel = firstTag(tags, "com.apple.quicktime.model", "model", "com.android.model")
 
 	for _, stream := range probe.Streams {
 		switch stream.CodecType {
 		case "video":
-			if meta.VideoCodec == "" {
+			// Skip embedded cover art
+			if meta.VideoCodec == "" && stream.Disposition.AttachedPic == 0 {
 				meta.VideoCodec = stream.CodecName
 				meta.Width = stream.Width
 				meta.Height = stream.Height
@@ -437,13 +1012,74 @@ func (s *Scanner) probeVideo(videoPath string) *videoMetadata {
 						meta.Framerate = num / den
 					}
 				}
+
+				meta.ColorTransfer = stream.ColorTransfer
+				switch stream.ColorTransfer {
+				case "smpte2084":
+					meta.HDRFormat = "HDR10"
+				case "arib-std-b67":
+					meta.HDRFormat = "HLG"
+				}
+
+				// The legacy rotate tag is clockwise; the display matrix,
+				// which newer ffprobe reports instead, is counter-clockwise
+				if rotate, err := strconv.Atoi(stream.Tags["rotate"]); err == nil {
+					meta.Rotation = rotate
+				}
+				for _, sd := range stream.SideDataList {
+					switch sd.SideDataType {
+					case "Display Matrix":
+						meta.Rotation = int(math.Round(-sd.Rotation))
+					case "DOVI configuration record":
+						meta.HDRFormat = "Dolby Vision"
+					}
+				}
+				meta.Rotation = ((meta.Rotation % 360) + 360) % 360
+
+				// Report display dimensions, so portrait clips are portrait
+				if meta.Rotation == 90 || meta.Rotation == 270 {
+					meta.Width, meta.Height = meta.Height, meta.Width
+				}
 			}
 		case "audio":
 			if meta.AudioCodec == "" {
 				meta.AudioCodec = stream.CodecName
+				meta.AudioChannels = stream.Channels
 			}
 		}
 	}
 
-	return meta
+	return meta, nil
+}
+
+func firstTag(tags map[string]string, keys ...string) string {
+	for _, k := range keys {
+		if v := strings.TrimSpace(tags[k]); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+var iso6709Pattern = regexp.MustCompile(`^([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)?`)
+
+// parseISO6709 parses the decimal degree form used by QuickTime's ©xyz
+// atom, e.g. "+59.9139+010.7522+012.000/".
+func parseISO6709(s string) (lat, lon, alt *float64) {
+	m := iso6709Pattern.FindStringSubmatch(s)
+	if m == nil {
+		return nil, nil, nil
+	}
+	la, err1 := strconv.ParseFloat(m[1], 64)
+	lo, err2 := strconv.ParseFloat(m[2], 64)
+	if err1 != nil || err2 != nil || math.Abs(la) > 90 || math.Abs(lo) > 180 {
+		return nil, nil, nil
+	}
+	lat, lon = &la, &lo
+	if m[3] != "" {
+		if a, err := strconv.ParseFloat(m[3], 64); err == nil {
+			alt = &a
+		}
+	}
+	return lat, lon, alt
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestParseVideoProbeRotation(t *testing.T) {
+	tests := []struct {
+		name     string
+		stream   string // extra stream fields
+		rotation int
+		width    int
+		height   int
+	}{
+		{"none", ``, 0, 1920, 1080},
+		{"tag only", `, "tags": {"rotate": "90"}`, 90, 1080, 1920},
+		{"display matrix only", `, "side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}]`, 90, 1080, 1920},
+		{"iphone portrait", `, "tags": {"rotate": "90"}, "side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}]`, 90, 1080, 1920},
+		{"upside down", `, "tags": {"rotate": "180"}, "side_data_list": [{"side_data_type": "Display Matrix", "rotation": 180}]`, 180, 1920, 1080},
+		{"counter-clockwise", `, "tags": {"rotate": "270"}, "side_data_list": [{"side_data_type": "Display Matrix", "rotation": 90}]`, 270, 1080, 1920},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := `{"streams": [{"codec_type": "video", "codec_name": "hevc", "width": 1920, "height": 1080` +
+				tt.stream + `}], "format": {"duration": "3.5"}}`
+			meta, err := parseVideoProbe([]byte(output))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.Rotation != tt.rotation || meta.Width != tt.width || meta.Height != tt.height {
+				t.Errorf("got rotation %d, %dx%d; want %d, %dx%d", meta.Rotation, meta.Width, meta.Height, tt.rotation, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestTooManyMissing(t *testing.T) {
+	s := &Scanner{cfg: &Config{CleanupMaxFraction: 0.1}}
+	tests := []struct {
+		missing, live int
+		want          bool
+	}{
+		{0, 0, false},
+		{1, 1, false},
+		{1, 5, false},
+		{2, 5, true},
+		{10, 100, false},
+		{11, 100, true},
+	}
+	for _, tt := range tests {
+		if got := s.tooManyMissing(tt.missing, tt.live); got != tt.want {
+			t.Errorf("tooManyMissing(%d, %d) = %v, want %v", tt.missing, tt.live, got, tt.want)
+		}
+	}
+}
+
+func TestParseISO6709(t *testing.T) {
+	tests := []struct {
+		in            string
+		lat, lon, alt *float64
+	}{
+		{"+59.9139+010.7522+012.000/", ptr(59.9139), ptr(10.7522), ptr(12.0)},
+		{"-33.8688+151.2093/", ptr(-33.8688), ptr(151.2093), nil},
+		{"+40-074/", ptr(40.0), ptr(-74.0), nil},
+		{"+00.0000-000.0000-005.5/", ptr(0.0), ptr(0.0), ptr(-5.5)},
+		{"", nil, nil, nil},
+		{"59.9139,10.7522", nil, nil, nil},
+		{"+91.0000+010.0000/", nil, nil, nil},
+		{"+10.0000+181.0000/", nil, nil, nil},
+	}
+	for _, tt := range tests {
+		lat, lon, alt := parseISO6709(tt.in)
+		if !equalPtr(lat, tt.lat) || !equalPtr(lon, tt.lon) || !equalPtr(alt, tt.alt) {
+			t.Errorf("parseISO6709(%q) = %v, %v, %v; want %v, %v, %v", tt.in,
+				fmtPtr(lat), fmtPtr(lon), fmtPtr(alt), fmtPtr(tt.lat), fmtPtr(tt.lon), fmtPtr(tt.alt))
+		}
+	}
+}
+
+func ptr(f float64) *float64 { return &f }
+
+func equalPtr(a, b *float64) bool {
+	return a == nil && b == nil || a != nil && b != nil && *a == *b
+}
+
+func fmtPtr(f *float64) string {
+	if f == nil {
+		return "nil"
+	}
+	return strconv.FormatFloat(*f, 'g', -1, 64)
+}
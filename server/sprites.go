@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+type SpriteTile struct {
+	ID     int64 `json:"id"`
+	X      int   `json:"x"`
+	Y      int   `json:"y"`
+	Width  int   `json:"width"`
+	Height int   `json:"height"`
+}
+
+// SpriteIndex locates each photo of one listing page inside its sprite
+// sheet. Pages follow the same order as ListPhotos for the folder.
+type SpriteIndex struct {
+	Folder   string       `json:"folder"`
+	Page     int          `json:"page"`
+	PageSize int          `json:"page_size"`
+	HasMore  bool         `json:"has_more"`
+	TileSize int          `json:"tile_size"`
+	Width    int          `json:"width"`
+	Height   int          `json:"height"`
+	Version  string       `json:"version"`
+	Tiles    []SpriteTile `json:"tiles"`
+
+	sources []string
+}
+
+// BuildSpriteIndex lays photos out on a square-ish grid of fixed cells,
+// fitting each thumbnail inside its cell. Photos without a thumbnail on disk
+// are left out. The version changes whenever the page's contents or
+// thumbnails change, so sheets are rebuilt only for pages that changed.
+func (c *Config) BuildSpriteIndex(folder string, page int, photos []*Photo, hasMore bool) *SpriteIndex {
+	tile := c.SpriteTileSize
+	columns := int(math.Ceil(math.Sqrt(float64(c.SpritePageSize))))
+	renditions := c.RenditionsBySize()
+	smallest := renditions[len(renditions)-1]
+
+	idx := &SpriteIndex{
+		Folder:   folder,
+		Page:     page,
+		PageSize: c.SpritePageSize,
+		HasMore:  hasMore,
+		TileSize: tile,
+		Tiles:    make([]SpriteTile, 0, len(photos)),
+	}
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d|%s|", tile, c.RenditionSignature())
+	for _, p := range photos {
+		src, err := c.RenditionPath(p.OriginalPath, smallest.Name, c.PrimaryFormat())
+		if err != nil {
+			continue
+		}
+		stat, err := os.Stat(src)
+		if err != nil {
+			src = p.ThumbnailPath
+			if stat, err = os.Stat(src); err != nil {
+				continue
+			}
+		}
+
+		aspect := p.AspectRatio
+		if aspect <= 0 && p.Width > 0 && p.Height > 0 {
+			aspect = float64(p.Width) / float64(p.Height)
+		}
+		if aspect <= 0 {
+			aspect = 1
+		}
+		w, ht := tile, tile
+		if aspect >= 1 {
+			ht = max(1, int(math.Round(float64(tile)/aspect)))
+		} else {
+			w = max(1, int(math.Round(float64(tile)*aspect)))
+		}
+
+		n := len(idx.Tiles)
+		col, row := n%columns, n/columns
+		idx.Tiles = append(idx.Tiles, SpriteTile{
+			ID:     p.ID,
+			X:      col*tile + (tile-w)/2,
+			Y:      row*tile + (tile-ht)/2,
+			Width:  w,
+			Height: ht,
+		})
+		idx.sources = append(idx.sources, src)
+		fmt.Fprintf(h, "%d:%d:%d|", p.ID, p.ModTime.UnixNano(), stat.ModTime().UnixNano())
+	}
+
+	rows := (len(idx.Tiles) + columns - 1) / columns
+	idx.Width = min(len(idx.Tiles), columns) * tile
+	idx.Height = rows * tile
+	idx.Version = fmt.Sprintf("%016x", h.Sum64())
+	return idx
+}
+
+// cacheKey names the sheet in the image cache. Stale versions are never
+// requested again and age out through LRU eviction.
+func (idx *SpriteIndex) cacheKey() string {
+	h := fnv.New64a()
+	h.Write([]byte(idx.Folder))
+	return fmt.Sprintf("sprites/%016x/%d-%s.jpg", h.Sum64(), idx.Page, idx.Version)
+}
+
+func renderSprite(idx *SpriteIndex, dst string, quality int) error {
+	if len(idx.Tiles) == 0 {
+		return fmt.Errorf("sprite page is empty")
+	}
+
+	args := []string{"-size", fmt.Sprintf("%dx%d", idx.Width, idx.Height), "xc:black"}
+	for i, t := range idx.Tiles {
+		args = append(args,
+			"(", idx.sources[i]+"[0]", "-resize", fmt.Sprintf("%dx%d!", t.Width, t.Height), ")",
+			"-geometry", fmt.Sprintf("+%d+%d", t.X, t.Y),
+			"-composite",
+		)
+	}
+	args = append(args, "-quality", strconv.Itoa(quality), "jpeg:"+dst)
+
+	if output, err := exec.Command("convert", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("convert failed: %w: %s", err, output)
+	}
+	return nil
+}
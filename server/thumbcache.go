@@ -0,0 +1,194 @@
+package main
+
+import (
+	"container/list"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CachedThumbnail is a thumbnail held in memory together with everything
+// needed to serve it without touching SQLite. Path, ModTime and Size
+// describe the file it was read from, so a copy that another process
+// regenerated is noticed.
+type CachedThumbnail struct {
+	PhotoID      int64
+	OriginalPath string
+	Path         string
+	Format       string
+	ETag         string
+	ModTime      time.Time
+	Size         int64
+	Data         []byte
+}
+
+// current reports whether the file the thumbnail was read from is
+// unchanged.
+func (t *CachedThumbnail) current() bool {
+	info, err := os.Stat(t.Path)
+	return err == nil && info.ModTime().Equal(t.ModTime) && info.Size() == t.Size
+}
+
+type ThumbnailCacheStats struct {
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	Entries int     `json:"entries"`
+	SizeMB  float64 `json:"size_mb"`
+}
+
+// ThumbnailCache is a bounded in-memory LRU of thumbnail bytes keyed by
+// photo, rendition and requested format.
+type ThumbnailCache struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	byPath  map[string][]string
+	size    int64
+
+	hits        atomic.Int64
+	misses      atomic.Int64
+	lastVariant atomic.Value
+	prefetching atomic.Bool
+}
+
+type thumbnailEntry struct {
+	key   string
+	thumb *CachedThumbnail
+}
+
+// thumbnailVariant is a rendition and format pair as requested by clients.
+type thumbnailVariant struct {
+	Rendition string
+	Format    string
+}
+
+func NewThumbnailCache(maxBytes int64) *ThumbnailCache {
+	return &ThumbnailCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		byPath:   make(map[string][]string),
+	}
+}
+
+func thumbnailCacheKey(id int64, rendition, format string) string {
+	return strconv.FormatInt(id, 10) + ":" + rendition + ":" + format
+}
+
+// Get returns a cached thumbnail if its file has not changed since it was
+// read. Thumbnails regenerated outside this process, such as by the CLI,
+// are dropped here rather than served with a stale ETag.
+func (c *ThumbnailCache) Get(id int64, rendition, format string) (*CachedThumbnail, bool) {
+	c.lastVariant.Store(thumbnailVariant{rendition, format})
+
+	c.mu.Lock()
+	el, ok := c.entries[thumbnailCacheKey(id, rendition, format)]
+	if !ok {
+		c.mu.Unlock()
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	thumb := el.Value.(*thumbnailEntry).thumb
+	c.mu.Unlock()
+
+	if !thumb.current() {
+		c.mu.Lock()
+		// Another request may have replaced the entry meanwhile
+		if cur, ok := c.entries[thumbnailCacheKey(id, rendition, format)]; ok && cur.Value.(*thumbnailEntry).thumb == thumb {
+			c.removeElement(cur)
+		}
+		c.mu.Unlock()
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return thumb, true
+}
+
+// Contains reports whether an entry is cached without counting as a hit or
+// affecting eviction order.
+func (c *ThumbnailCache) Contains(id int64, rendition, format string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[thumbnailCacheKey(id, rendition, format)]
+	return ok
+}
+
+func (c *ThumbnailCache) Add(rendition, format string, t *CachedThumbnail) {
+	size := int64(len(t.Data))
+	if size > c.maxBytes {
+		return
+	}
+	key := thumbnailCacheKey(t.PhotoID, rendition, format)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+	c.entries[key] = c.lru.PushFront(&thumbnailEntry{key: key, thumb: t})
+	c.byPath[t.OriginalPath] = append(c.byPath[t.OriginalPath], key)
+	c.size += size
+
+	for c.size > c.maxBytes {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// Invalidate drops every cached rendition of an original, called when the
+// scanner regenerates or removes its thumbnails.
+func (c *ThumbnailCache) Invalidate(originalPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range c.byPath[originalPath] {
+		if el, ok := c.entries[key]; ok {
+			c.removeElement(el)
+		}
+	}
+	delete(c.byPath, originalPath)
+}
+
+// removeElement unlinks an entry. The caller must hold c.mu.
+func (c *ThumbnailCache) removeElement(el *list.Element) {
+	entry := el.Value.(*thumbnailEntry)
+	c.lru.Remove(el)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.thumb.Data))
+
+	path := entry.thumb.OriginalPath
+	keys := c.byPath[path]
+	for i, k := range keys {
+		if k == entry.key {
+			keys = append(keys[:i], keys[i+1:]...)
+			break
+		}
+	}
+	if len(keys) == 0 {
+		delete(c.byPath, path)
+	} else {
+		c.byPath[path] = keys
+	}
+}
+
+// LastVariant returns the most recently requested rendition and format, so
+// prefetching warms what clients are actually loading.
+func (c *ThumbnailCache) LastVariant() (thumbnailVariant, bool) {
+	v, ok := c.lastVariant.Load().(thumbnailVariant)
+	return v, ok
+}
+
+func (c *ThumbnailCache) Stats() *ThumbnailCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &ThumbnailCacheStats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Entries: len(c.entries),
+		SizeMB:  float64(c.size) / (1 << 20),
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestThumbnailCacheDropsChangedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "thumb.jpg")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewThumbnailCache(1 << 20)
+	c.Add("grid", "jpeg", &CachedThumbnail{PhotoID: 1, OriginalPath: "/a.jpg", Path: path, ModTime: info.ModTime(), Size: info.Size(), Data: []byte("old")})
+	if _, ok := c.Get(1, "grid", "jpeg"); !ok {
+		t.Fatal("unchanged file missed the cache")
+	}
+
+	// Another process regenerates the thumbnail
+	if err := os.WriteFile(path, []byte("newer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get(1, "grid", "jpeg"); ok {
+		t.Fatal("changed file was served from the cache")
+	}
+	if c.Contains(1, "grid", "jpeg") {
+		t.Fatal("stale entry was kept")
+	}
+}
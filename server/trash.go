@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// trashDirName is the directory under OriginalsPath that originals deleted
+// through the API are moved to. The scanner does not index it.
+const trashDirName = ".trash"
+
+var (
+	errNotTrashed      = errors.New("photo is not in the trash")
+	errOriginalExists  = errors.New("a file already exists at the original path")
+	errOriginalMissing = errors.New("original is missing and was not moved to the trash")
+)
+
+func (s *Scanner) trashDir() string {
+	return filepath.Join(s.cfg.OriginalsPath, trashDirName)
+}
+
+// Trash moves an original and its companions into the trash directory and
+// marks its row deleted. The row keeps its ID and settings so a restore is
+// lossless.
+func (s *Scanner) Trash(p *Photo) error {
+	if !s.mu.TryLock() {
+		return errScanRunning
+	}
+	defer s.unlock()
+
+	return s.trash(p, time.Now(), true)
+}
+
+// trash moves p's original into a directory of its own, so equal filenames
+// cannot collide. Unindexed companions such as sidecars go with it; indexed
+// ones are trashed as rows of their own, deleted at the same time so they
+// can be restored together.
+func (s *Scanner) trash(p *Photo, now time.Time, companions bool) error {
+	if p.DeletedAt != nil {
+		return nil
+	}
+
+	var others []string
+	if companions {
+		others = companionFiles(p.OriginalPath)
+	}
+	dir := filepath.Join(s.trashDir(), strconv.FormatInt(p.ID, 10))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create trash directory: %w", err)
+	}
+	dest := filepath.Join(dir, filepath.Base(p.OriginalPath))
+	if err := moveFile(p.OriginalPath, dest); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		dest = ""
+	}
+
+	if err := s.db.SetDeleted(p.OriginalPath, &now, dest); err != nil {
+		return err
+	}
+	s.thumbs.Invalidate(p.OriginalPath)
+	p.DeletedAt, p.TrashPath = &now, dest
+
+	for _, c := range others {
+		if row, err := s.db.GetPhotoByPath(c); err == nil {
+			err = s.trash(row, now, false)
+			if err != nil {
+				log.Printf("Error trashing companion %s: %v", c, err)
+			}
+			continue
+		}
+		if err := moveFile(c, filepath.Join(dir, filepath.Base(c))); err != nil {
+			log.Printf("Error trashing companion %s: %v", c, err)
+		}
+	}
+	return nil
+}
+
+// Restore takes a row out of the trash, moving its original and companions
+// back if the API deleted it. Indexed companions trashed along with it are
+// restored too, and nothing is moved unless every file can go back. Items
+// that went missing from disk can only be restored once the file is back.
+func (s *Scanner) Restore(p *Photo) error {
+	if !s.mu.TryLock() {
+		return errScanRunning
+	}
+	defer s.unlock()
+
+	if p.DeletedAt == nil {
+		return errNotTrashed
+	}
+	companions, err := s.trashedCompanions(p)
+	if err != nil {
+		return err
+	}
+
+	items := append([]*Photo{p}, companions...)
+	var moves []fileMove
+	for _, item := range items {
+		m, err := restoreMoves(item)
+		if err != nil {
+			return err
+		}
+		moves = append(moves, m...)
+	}
+	if err := os.MkdirAll(filepath.Dir(p.OriginalPath), 0755); err != nil {
+		return err
+	}
+	for _, m := range moves {
+		if err := moveFile(m.src, m.dst); err != nil {
+			return err
+		}
+	}
+
+	for _, item := range items {
+		if item.TrashPath != "" {
+			os.Remove(filepath.Dir(item.TrashPath))
+		}
+		if err := s.db.SetDeleted(item.OriginalPath, nil, ""); err != nil {
+			return err
+		}
+		item.DeletedAt, item.TrashPath = nil, ""
+	}
+	return nil
+}
+
+// restoreMoves lists the moves that bring p's trashed files back, failing
+// if anything is in the way.
+func restoreMoves(p *Photo) ([]fileMove, error) {
+	if p.TrashPath == "" {
+		if _, err := os.Stat(p.OriginalPath); err != nil {
+			return nil, errOriginalMissing
+		}
+		return nil, nil
+	}
+
+	dir := filepath.Dir(p.TrashPath)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// The item may have been renamed since it was trashed; its companions
+	// follow the new name
+	trashedName, name := filepath.Base(p.TrashPath), filepath.Base(p.OriginalPath)
+	var moves []fileMove
+	for _, e := range entries {
+		dst := companionName(e.Name(), trashedName, name)
+		if e.Name() == trashedName {
+			dst = name
+		}
+		m := fileMove{filepath.Join(dir, e.Name()), filepath.Join(filepath.Dir(p.OriginalPath), dst)}
+		if _, err := os.Lstat(m.dst); err == nil {
+			return nil, fmt.Errorf("%w: %s", errOriginalExists, e.Name())
+		}
+		moves = append(moves, m)
+	}
+	return moves, nil
+}
+
+// trashedCompanions returns the indexed companions that were trashed in
+// the same call as p and still have their files in the trash.
+func (s *Scanner) trashedCompanions(p *Photo) ([]*Photo, error) {
+	trashed, err := s.db.ListPhotos(PhotoFilter{Folder: p.Folder, Trash: true}, -1, 0)
+	if err != nil {
+		return nil, err
+	}
+	var companions []*Photo
+	for _, c := range trashed {
+		// The folder filter uses LIKE, so check c is really beside p
+		if c.ID == p.ID || c.TrashPath == "" || filepath.Dir(c.OriginalPath) != filepath.Dir(p.OriginalPath) {
+			continue
+		}
+		if c.DeletedAt.Equal(*p.DeletedAt) && isCompanion(c.Filename, p.Filename) {
+			companions = append(companions, c)
+		}
+	}
+	return companions, nil
+}
+
+// reclaimPath handles a file found where a trashed row still points. A
+// missing original that came back, or a trashed file put back by hand,
+// restores the row. Any other file takes over the path: the trashed item is
+// renamed to a free name, which is where restoring puts it, so nothing in
+// the trash is lost.
+func (s *Scanner) reclaimPath(path string) {
+	p, err := s.db.GetPhotoByPath(path)
+	if err != nil || p.DeletedAt == nil {
+		return
+	}
+
+	if p.TrashPath == "" || s.sameContent(path, p) {
+		if err := s.db.SetDeleted(path, nil, ""); err != nil {
+			log.Printf("Error restoring %s: %v", path, err)
+			return
+		}
+		// The file was put back by hand, so the trashed copy is redundant
+		s.dropTrashed(p)
+		return
+	}
+
+	newPath := s.freePath(path)
+	s.moveThumbnails(p, newPath)
+	if err := s.db.Relocate([]string{path}, []*Photo{s.movedPhoto(p, newPath)}); err != nil {
+		log.Printf("Error renaming trashed %s: %v", path, err)
+		return
+	}
+	s.thumbs.Invalidate(path)
+	log.Printf("A new file took the place of trashed %s; the trashed item will restore to %s", path, newPath)
+}
+
+// sameContent reports whether the file at path is the trashed original of
+// p.
+func (s *Scanner) sameContent(path string, p *Photo) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	trashed, err := os.Stat(p.TrashPath)
+	if err != nil || trashed.Size() != info.Size() {
+		return false
+	}
+	want := p.ContentHash
+	if want == "" {
+		if want, err = fileHash(p.TrashPath); err != nil {
+			return false
+		}
+	}
+	got, err := fileHash(path)
+	return err == nil && got == want
+}
+
+// freePath returns path, or path with a " (n)" suffix before the extension,
+// such that neither a file nor a row uses it.
+func (s *Scanner) freePath(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		if _, err := os.Lstat(candidate); !os.IsNotExist(err) {
+			continue
+		}
+		if _, err := s.db.GetPhotoByPath(candidate); err == nil {
+			continue
+		}
+		return candidate
+	}
+}
+
+// dropTrashed removes the trash directory of an item whose original is back
+// in place. Companions trashed with it are put back beside it first, unless
+// something took their place.
+func (s *Scanner) dropTrashed(p *Photo) {
+	if p.TrashPath == "" {
+		return
+	}
+	dir := filepath.Dir(p.TrashPath)
+	entries, _ := os.ReadDir(dir)
+	trashedName, name := filepath.Base(p.TrashPath), filepath.Base(p.OriginalPath)
+	for _, e := range entries {
+		if e.Name() == trashedName {
+			continue
+		}
+		dst := filepath.Join(filepath.Dir(p.OriginalPath), companionName(e.Name(), trashedName, name))
+		if _, err := os.Lstat(dst); !os.IsNotExist(err) {
+			continue
+		}
+		if err := moveFile(filepath.Join(dir, e.Name()), dst); err != nil {
+			log.Printf("Error restoring companion %s: %v", dst, err)
+		}
+	}
+	s.purgeTrashed(p.TrashPath)
+}
+
+// purgeTrashed deletes a trashed original along with its companions.
+func (s *Scanner) purgeTrashed(trashPath string) {
+	if dir := filepath.Dir(trashPath); trashPath != "" && filepath.Dir(dir) == s.trashDir() {
+		os.RemoveAll(dir)
+	}
+}
+
+// moveFile renames src to dst, copying across filesystems when the trash
+// and the original are on different datasets.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	os.Chtimes(dst, info.ModTime(), info.ModTime())
+	return os.Remove(src)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Uploads follow the tus 1.0 resumable upload protocol with the creation,
+// checksum and termination extensions: a POST announces the file, PATCH
+// requests append chunks at the current offset, and HEAD tells a client
+// where to resume after a dropped connection.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,checksum,termination"
+	tusChecksums  = "sha1,sha256"
+	uploadExpiry  = 24 * time.Hour
+)
+
+var (
+	errUploadNotFound   = errors.New("upload not found")
+	errUploadBusy       = errors.New("upload is already receiving data")
+	errOffsetMismatch   = errors.New("offset does not match the upload")
+	errUploadTooLong    = errors.New("data exceeds the upload length")
+	errChecksumMismatch = errors.New("checksum mismatch")
+	errChecksumAlgo     = errors.New("unsupported checksum algorithm")
+	errUnsupportedFile  = errors.New("unsupported file type")
+)
+
+// upload is the state of one upload, kept next to its data so uploads
+// survive a restart.
+type upload struct {
+	ID       string    `json:"id"`
+	Filename string    `json:"filename"`
+	Length   int64     `json:"length"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// UploadResult describes a finished upload. Photo is nil when the file was
+// left for the next scan to index.
+type UploadResult struct {
+	Path      string
+	Photo     *Photo
+	Duplicate bool
+}
+
+type Uploader struct {
+	cfg     *Config
+	scanner *Scanner
+	dir     string
+
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+func NewUploader(cfg *Config, scanner *Scanner) (*Uploader, error) {
+	if err := os.MkdirAll(cfg.UploadTempPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	u := &Uploader{cfg: cfg, scanner: scanner, dir: cfg.UploadTempPath, active: make(map[string]bool)}
+	u.expire()
+	return u, nil
+}
+
+func (u *Uploader) dataPath(id string) string {
+	return filepath.Join(u.dir, id+".part")
+}
+
+func (u *Uploader) infoPath(id string) string {
+	return filepath.Join(u.dir, id+".json")
+}
+
+// Create starts an upload of length bytes that will be saved as filename.
+// sum, a hex SHA-256 if given, is checked against the whole file once it
+// is complete.
+func (u *Uploader) Create(filename string, length int64, sum string) (*upload, error) {
+	u.expire()
+
+	if filename != filepath.Base(filename) || strings.HasPrefix(filename, ".") || strings.ContainsAny(filename, `/\`) {
+		return nil, errInvalidName
+	}
+	if !u.scanner.isSupportedExtension(strings.ToLower(filepath.Ext(filename))) {
+		return nil, errUnsupportedFile
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	up := &upload{
+		ID:       hex.EncodeToString(id),
+		Filename: filename,
+		Length:   length,
+		SHA256:   strings.ToLower(sum),
+		Created:  time.Now(),
+	}
+	data, err := json.Marshal(up)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(u.dataPath(up.ID), nil, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(u.infoPath(up.ID), data, 0644); err != nil {
+		os.Remove(u.dataPath(up.ID))
+		return nil, err
+	}
+	return up, nil
+}
+
+// Get returns an upload and the number of bytes received so far.
+func (u *Uploader) Get(id string) (*upload, int64, error) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		return nil, 0, errUploadNotFound
+	}
+	data, err := os.ReadFile(u.infoPath(id))
+	if err != nil {
+		return nil, 0, errUploadNotFound
+	}
+	var up upload
+	if err := json.Unmarshal(data, &up); err != nil {
+		return nil, 0, err
+	}
+	info, err := os.Stat(u.dataPath(id))
+	if err != nil {
+		return nil, 0, errUploadNotFound
+	}
+	return &up, info.Size(), nil
+}
+
+// Append writes a chunk at offset and returns the new offset. checksum is
+// an optional Upload-Checksum value; a chunk that does not match it is
+// discarded. When the last byte arrives the upload is finished and its
+// result returned.
+func (u *Uploader) Append(id string, offset int64, body io.Reader, checksum string) (int64, *UploadResult, error) {
+	u.mu.Lock()
+	if u.active[id] {
+		u.mu.Unlock()
+		return 0, nil, errUploadBusy
+	}
+	u.active[id] = true
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		delete(u.active, id)
+		u.mu.Unlock()
+	}()
+
+	up, current, err := u.Get(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	if offset != current {
+		return current, nil, errOffsetMismatch
+	}
+
+	var sum hash.Hash
+	var want string
+	if checksum != "" {
+		algo, value, _ := strings.Cut(checksum, " ")
+		switch algo {
+		case "sha1":
+			sum = sha1.New()
+		case "sha256":
+			sum = sha256.New()
+		default:
+			return current, nil, errChecksumAlgo
+		}
+		want = value
+		body = io.TeeReader(body, sum)
+	}
+
+	f, err := os.OpenFile(u.dataPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return current, nil, err
+	}
+	// Read one byte past the end so overlong requests are noticed
+	n, err := io.Copy(f, io.LimitReader(body, up.Length-current+1))
+	if err == nil && current+n > up.Length {
+		err = errUploadTooLong
+	}
+	if err == nil && sum != nil && base64.StdEncoding.EncodeToString(sum.Sum(nil)) != want {
+		err = errChecksumMismatch
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if errors.Is(err, errUploadTooLong) || errors.Is(err, errChecksumMismatch) {
+		os.Truncate(u.dataPath(id), current)
+		return current, nil, err
+	}
+	// A dropped connection keeps what arrived, which is the point of resuming
+	offset = current + n
+	if err != nil {
+		return offset, nil, err
+	}
+	if offset < up.Length {
+		return offset, nil, nil
+	}
+
+	result, err := u.finish(up)
+	return offset, result, err
+}
+
+// finish verifies a complete upload, drops it if the library already has
+// the same content, and otherwise moves it into the originals and indexes
+// it. If that fails the data goes back and the upload is kept, so the
+// client can retry the last request.
+func (u *Uploader) finish(up *upload) (*UploadResult, error) {
+	data := u.dataPath(up.ID)
+
+	sum, err := fileHash(data)
+	if err != nil {
+		return nil, err
+	}
+	if up.SHA256 != "" && sum != up.SHA256 {
+		u.remove(up.ID)
+		return nil, errChecksumMismatch
+	}
+	folder := u.cfg.UploadInbox
+	if u.cfg.UploadByDate {
+		if t := u.scanner.captureInfo(data, up.Filename).CapturedAt; t != nil {
+			folder = t.Format("2006/01-02")
+		}
+	}
+	dir := filepath.Join(u.cfg.OriginalsPath, folder)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// Bring the data next to its destination under a name the scanner
+	// skips, so claiming the final name cannot cross filesystems
+	tmp := filepath.Join(dir, "."+up.ID+".uploading")
+	if err := moveFile(data, tmp); err != nil {
+		return nil, err
+	}
+	result, err := u.scanner.Place(tmp, filepath.Join(dir, up.Filename), up.Length, sum)
+	if err != nil {
+		if err := moveFile(tmp, data); err != nil {
+			os.Remove(tmp)
+			u.remove(up.ID)
+		}
+		return nil, err
+	}
+	u.remove(up.ID)
+	if result.Duplicate {
+		log.Printf("Upload of %s is a duplicate of %s", up.Filename, result.Path)
+	} else {
+		log.Printf("Uploaded %s", result.Path)
+	}
+	return result, nil
+}
+
+// Terminate abandons an upload and deletes what was received.
+func (u *Uploader) Terminate(id string) error {
+	if _, _, err := u.Get(id); err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.active[id] {
+		return errUploadBusy
+	}
+	u.remove(id)
+	return nil
+}
+
+func (u *Uploader) remove(id string) {
+	os.Remove(u.dataPath(id))
+	os.Remove(u.infoPath(id))
+}
+
+// expire removes uploads that have received nothing for uploadExpiry.
+func (u *Uploader) expire() {
+	matches, _ := filepath.Glob(filepath.Join(u.dir, "*.part"))
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err == nil && time.Since(info.ModTime()) > uploadExpiry {
+			u.remove(strings.TrimSuffix(filepath.Base(path), ".part"))
+		}
+	}
+}
+
+// claimPath moves tmp to path, or to path with a " (n)" suffix before the
+// extension if that name is taken, and returns where it went. tmp must be
+// in the same folder. The name is claimed with a hard link, which fails
+// rather than overwrite a file that appeared meanwhile; filesystems without
+// hard links get a rename once the name is seen to be free.
+func claimPath(tmp, path string) (string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for n := 1; ; n++ {
+		err := os.Link(tmp, path)
+		if err == nil {
+			os.Remove(tmp)
+			return path, nil
+		}
+		if !os.IsExist(err) {
+			_, err := os.Lstat(path)
+			if os.IsNotExist(err) {
+				return path, os.Rename(tmp, path)
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+		path = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header: comma separated
+// keys, each followed by a space and a base64 value.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, " ")
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata value for %q", key)
+		}
+		meta[key] = string(decoded)
+	}
+	return meta, nil
+}
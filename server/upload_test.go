@@ -0,0 +1,76 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseUploadMetadata(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   map[string]string // nil for an error
+	}{
+		{"empty", "", map[string]string{}},
+		{"filename", "filename aW1nLmpwZw==", map[string]string{"filename": "img.jpg"}},
+		{"several", "filename aW1nLmpwZw==,sha256 YWJj, is_private",
+			map[string]string{"filename": "img.jpg", "sha256": "abc", "is_private": ""}},
+		{"trailing comma", "filename aW1nLmpwZw==,", map[string]string{"filename": "img.jpg"}},
+		{"unicode", "filename w6ZibGUuanBn", map[string]string{"filename": "æble.jpg"}},
+		{"bad base64", "filename not base64!", nil},
+		{"unpadded", "filename aW1nLmpwZw", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseUploadMetadata(tt.header)
+			switch {
+			case tt.want == nil && err == nil:
+				t.Errorf("got %v, want error", got)
+			case tt.want != nil && err != nil:
+				t.Error(err)
+			case tt.want != nil && !maps.Equal(got, tt.want):
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaimPath(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.jpg", "a (1).jpg"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("taken"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		path, want string
+	}{
+		{"b.jpg", "b.jpg"},
+		{"a.jpg", "a (2).jpg"},
+		{"a.jpg", "a (3).jpg"},
+	}
+	for _, tt := range tests {
+		tmp := filepath.Join(dir, ".upload-tmp")
+		if err := os.WriteFile(tmp, []byte(tt.want), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := claimPath(tmp, filepath.Join(dir, tt.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != filepath.Join(dir, tt.want) {
+			t.Errorf("claimPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+		if data, _ := os.ReadFile(got); string(data) != tt.want {
+			t.Errorf("%s holds %q", tt.want, data)
+		}
+		if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+			t.Errorf("tmp left behind: %v", err)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "a.jpg")); string(data) != "taken" {
+		t.Errorf("a.jpg overwritten: %q", data)
+	}
+}
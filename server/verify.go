@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Verify categories, also used to select repairs.
+const (
+	verifyMissing    = "missing"
+	verifyChanged    = "changed"
+	verifyThumbnails = "thumbnails"
+	verifyOrphans    = "orphans"
+)
+
+func verifyCategories() []string {
+	return []string{verifyMissing, verifyChanged, verifyThumbnails, verifyOrphans}
+}
+
+type ThumbnailProblem struct {
+	OriginalPath string `json:"original_path"`
+	Path         string `json:"path"`
+	Problem      string `json:"problem"`
+}
+
+// VerifyReport lists disagreements between the photos table and disk.
+type VerifyReport struct {
+	Checked          int                `json:"checked"`
+	MissingOriginals []string           `json:"missing_originals"`
+	ChangedOriginals []string           `json:"changed_originals"`
+	BadThumbnails    []ThumbnailProblem `json:"bad_thumbnails"`
+	OrphanThumbnails []string           `json:"orphan_thumbnails"`
+	Integrity        string             `json:"integrity"`
+
+	live int // rows not in the trash, for cleanup_max_fraction
+}
+
+func (r *VerifyReport) Problems() int {
+	n := len(r.MissingOriginals) + len(r.ChangedOriginals) + len(r.BadThumbnails) + len(r.OrphanThumbnails)
+	if r.Integrity != "ok" {
+		n++
+	}
+	return n
+}
+
+// Verify cross-checks every row against its original and generated files,
+// looks for generated files with no row, and runs SQLite's integrity check.
+func (s *Scanner) Verify() (*VerifyReport, error) {
+	report := &VerifyReport{Integrity: "ok"}
+	if err := s.db.CheckIntegrity(); err != nil {
+		report.Integrity = err.Error()
+	}
+
+	photos, err := s.db.AllPhotos()
+	if err != nil {
+		return nil, err
+	}
+	report.Checked = len(photos)
+
+	expected := make(map[string]bool)
+	for _, p := range photos {
+		for _, path := range s.generatedPaths(p) {
+			expected[path] = true
+		}
+		// Trashed originals are expected to be gone
+		if p.DeletedAt != nil {
+			continue
+		}
+		report.live++
+
+		info, err := os.Stat(p.OriginalPath)
+		if err != nil {
+			report.MissingOriginals = append(report.MissingOriginals, p.OriginalPath)
+			continue
+		}
+		if info.Size() != p.FileSize || !info.ModTime().Equal(p.ModTime) {
+			report.ChangedOriginals = append(report.ChangedOriginals, p.OriginalPath)
+			continue
+		}
+
+		for _, path := range s.thumbnailsToCheck(p) {
+			if problem := checkImageFile(path); problem != "" {
+				report.BadThumbnails = append(report.BadThumbnails, ThumbnailProblem{p.OriginalPath, path, problem})
+			}
+		}
+	}
+
+	for _, dir := range s.generatedDirs() {
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if !expected[path] {
+				report.OrphanThumbnails = append(report.OrphanThumbnails, path)
+			}
+			return nil
+		})
+	}
+
+	return report, nil
+}
+
+// generatedPaths lists every file the scanner may have written for p.
+func (s *Scanner) generatedPaths(p *Photo) []string {
+	return append([]string{p.ThumbnailPath}, s.derivedPaths(p.OriginalPath, p.MediaType == "video")...)
+}
+
+// derivedPaths lists the rendition and video asset paths of an original in
+// a fixed order, so two lists can be paired up when an original moves.
+func (s *Scanner) derivedPaths(originalPath string, isVideo bool) []string {
+	var paths []string
+	for _, r := range s.cfg.Renditions {
+		for _, format := range s.cfg.ThumbnailFormats {
+			if path, err := s.cfg.RenditionPath(originalPath, r.Name, format); err == nil {
+				paths = append(paths, path)
+			}
+		}
+	}
+	if isVideo {
+		for _, kind := range videoAssetKinds() {
+			if path, err := s.cfg.VideoAssetPath(originalPath, kind); err == nil {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths
+}
+
+// thumbnailsToCheck is the served thumbnail plus every rendition in the
+// primary format, which are always generated.
+func (s *Scanner) thumbnailsToCheck(p *Photo) []string {
+	paths := []string{p.ThumbnailPath}
+	for _, r := range s.cfg.Renditions {
+		path, err := s.cfg.RenditionPath(p.OriginalPath, r.Name, s.cfg.PrimaryFormat())
+		if err == nil && path != p.ThumbnailPath {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// generatedDirs are the directories holding per-item files. Caches and
+// backups are left out since their entries are not tied to rows.
+func (s *Scanner) generatedDirs() []string {
+	var dirs []string
+	for _, r := range s.cfg.Renditions {
+		dirs = append(dirs, filepath.Join(s.cfg.ThumbnailsPath, r.Name))
+	}
+	for _, kind := range videoAssetKinds() {
+		dirs = append(dirs, filepath.Join(s.cfg.ThumbnailsPath, ".video", kind))
+	}
+	return dirs
+}
+
+// checkImageFile returns a description of what is wrong with a thumbnail,
+// or "" if it is readable. JPEG and PNG are fully decoded; other formats
+// are checked for their signature.
+func checkImageFile(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "missing"
+		}
+		return err.Error()
+	}
+	if len(data) == 0 {
+		return "empty"
+	}
+
+	switch formatFromPath(path) {
+	case "jpeg":
+		if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+			return "corrupt: " + err.Error()
+		}
+	case "png":
+		if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+			return "corrupt: " + err.Error()
+		}
+	case "webp":
+		if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+			return "corrupt: not a WebP file"
+		}
+	case "avif":
+		if len(data) < 12 || string(data[4:8]) != "ftyp" {
+			return "corrupt: not an AVIF file"
+		}
+	}
+	return ""
+}
+
+// Repair fixes the selected categories of a report. Missing originals are
+// marked deleted, as cleanup does, so they are purged after the grace
+// period; changed originals and items with bad thumbnails are reprocessed,
+// and orphaned files are deleted. Database corruption cannot be repaired
+// here; restore a backup instead.
+//
+// Missing originals are left alone, and the reason returned, when the
+// originals look unmounted or when more than cleanup_max_fraction are
+// missing unless force is set. The other categories are still repaired.
+func (s *Scanner) Repair(report *VerifyReport, categories []string, force bool) error {
+	selected := make(map[string]bool)
+	for _, c := range categories {
+		selected[c] = true
+	}
+
+	var err error
+	if selected[verifyMissing] {
+		err = s.repairMissing(report.MissingOriginals, report.live, force)
+	}
+
+	var reprocess []string
+	if selected[verifyChanged] {
+		reprocess = append(reprocess, report.ChangedOriginals...)
+	}
+	if selected[verifyThumbnails] {
+		seen := make(map[string]bool)
+		for _, t := range report.BadThumbnails {
+			if !seen[t.OriginalPath] {
+				seen[t.OriginalPath] = true
+				reprocess = append(reprocess, t.OriginalPath)
+			}
+		}
+	}
+	for _, path := range reprocess {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("Skipping %s: %v", path, err)
+			continue
+		}
+		s.process(path, info)
+	}
+
+	if selected[verifyOrphans] {
+		for _, path := range report.OrphanThumbnails {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error removing orphan %s: %v", path, err)
+			}
+		}
+	}
+	return err
+}
+
+func (s *Scanner) repairMissing(missing []string, live int, force bool) error {
+	if len(missing) == 0 {
+		return nil
+	}
+	if err := s.checkOriginals(); err != nil {
+		return fmt.Errorf("missing originals not repaired: %w", err)
+	}
+	if !force && s.tooManyMissing(len(missing), live) {
+		return fmt.Errorf("missing originals not repaired: %d of %d are missing, more than cleanup_max_fraction %g; use -force if they were deleted on purpose",
+			len(missing), live, s.cfg.CleanupMaxFraction)
+	}
+	now := time.Now()
+	for _, path := range missing {
+		if err := s.db.SetDeleted(path, &now, ""); err != nil {
+			log.Printf("Error marking %s deleted: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// parseRepairCategories accepts a comma separated list of categories or
+// "all".
+func parseRepairCategories(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if s == "all" {
+		return verifyCategories(), nil
+	}
+	categories := strings.Split(s, ",")
+	for _, c := range categories {
+		if !slices.Contains(verifyCategories(), c) {
+			return nil, fmt.Errorf("unknown repair category %q (want %s or all)", c, strings.Join(verifyCategories(), ", "))
+		}
+	}
+	return categories, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/jpeg"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	videoPreviewHeight = 360
+	scrubFrameHeight   = 90
+)
+
+// ScrubIndex maps the frames of a scrub strip to their timestamps. Frames
+// are laid out left to right, each FrameWidth pixels wide.
+type ScrubIndex struct {
+	FrameCount  int       `json:"frame_count"`
+	FrameWidth  int       `json:"frame_width"`
+	FrameHeight int       `json:"frame_height"`
+	Interval    float64   `json:"interval"`
+	Timestamps  []float64 `json:"timestamps"`
+}
+
+// VideoAssetPath returns where a generated video asset lives. Assets are
+// kept outside the rendition subtrees so rendition names cannot collide.
+func (c *Config) VideoAssetPath(originalPath, kind string) (string, error) {
+	relPath, err := filepath.Rel(c.OriginalsPath, originalPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to get relative path: %w", err)
+	}
+	ext := map[string]string{"preview": ".mp4", "scrub": ".jpg", "scrub-index": ".json"}[kind]
+	return filepath.Join(c.ThumbnailsPath, ".video", kind, strings.TrimSuffix(relPath, filepath.Ext(relPath))+ext), nil
+}
+
+func videoAssetKinds() []string {
+	return []string{"preview", "scrub", "scrub-index"}
+}
+
+// generateVideoPreviews writes a short silent looping preview clip and a
+// scrub strip of evenly spaced frames with its timing index. Clips with
+// fewer frames than scrub_frames get one tile per frame.
+func (s *Scanner) generateVideoPreviews(videoPath string, duration, framerate float64) error {
+	if duration <= 0 {
+		return fmt.Errorf("unknown duration")
+	}
+
+	paths := make(map[string]string)
+	for _, kind := range videoAssetKinds() {
+		p, err := s.cfg.VideoAssetPath(videoPath, kind)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return fmt.Errorf("failed to create video preview directory: %w", err)
+		}
+		paths[kind] = p
+	}
+
+	// Start a little way in to skip fade-ins, keeping the clip within the video
+	length := min(float64(s.cfg.VideoPreviewSeconds), duration)
+	start := min(duration*0.1, duration-length)
+	args := []string{
+		"-ss", fmt.Sprintf("%.2f", start),
+		"-t", fmt.Sprintf("%.2f", length),
+		"-i", videoPath,
+		"-an",
+		"-vf", fmt.Sprintf("scale=-2:%d", videoPreviewHeight),
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-crf", "28",
+		"-pix_fmt", "yuv420p",
+		"-movflags", "+faststart",
+	}
+	args = append(args, s.cfg.ffmpegMetadataArgs()...)
+	cmd := exec.Command("ffmpeg", append(args, "-y", paths["preview"])...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg preview failed: %w: %s", err, output)
+	}
+
+	frames := s.cfg.ScrubFrames
+	if n := int(duration * framerate); framerate > 0 && n < frames {
+		frames = max(n, 1)
+	}
+	interval := duration / float64(frames)
+	cmd = exec.Command("ffmpeg",
+		"-i", videoPath,
+		"-an",
+		"-vf", fmt.Sprintf("fps=1/%s,scale=-2:%d,tile=%dx1", strconv.FormatFloat(interval, 'f', 4, 64), scrubFrameHeight, frames),
+		"-frames:v", "1",
+		"-q:v", "4",
+		"-y",
+		paths["scrub"],
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg scrub strip failed: %w: %s", err, output)
+	}
+
+	f, err := os.Open(paths["scrub"])
+	if err != nil {
+		return err
+	}
+	strip, err := jpeg.DecodeConfig(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read scrub strip: %w", err)
+	}
+
+	index := ScrubIndex{
+		FrameCount:  frames,
+		FrameWidth:  strip.Width / frames,
+		FrameHeight: strip.Height,
+		Interval:    interval,
+		Timestamps:  make([]float64, frames),
+	}
+	for i := range index.Timestamps {
+		index.Timestamps[i] = float64(i) * interval
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(paths["scrub-index"], data, 0644)
+}
+
+// backfillVideoPreviews generates previews for videos indexed before they
+// were introduced or whose previews are missing. Failures are recorded and
+// not retried until the video is processed again.
+func (s *Scanner) backfillVideoPreviews() {
+	videos, err := s.db.VideosWithoutPreviewError()
+	if err != nil {
+		log.Printf("Error fetching videos for preview backfill: %v", err)
+		return
+	}
+
+	for _, v := range videos {
+		missing := false
+		for _, kind := range videoAssetKinds() {
+			p, err := s.cfg.VideoAssetPath(v.OriginalPath, kind)
+			if err != nil {
+				break
+			}
+			if _, err := os.Stat(p); err != nil {
+				missing = true
+				break
+			}
+		}
+		if !missing {
+			continue
+		}
+		if err := s.generateVideoPreviews(v.OriginalPath, v.Duration, v.Framerate); err != nil {
+			log.Printf("Error generating video previews for %s: %v", v.OriginalPath, err)
+			if err := s.db.SetPreviewError(v.OriginalPath, err.Error()); err != nil {
+				log.Printf("Error recording preview failure for %s: %v", v.OriginalPath, err)
+			}
+		}
+	}
+}